@@ -0,0 +1,366 @@
+// Package conformance checks broker implementations against the behaviour
+// expected of a go-micro broker. Each behaviour is a named case which a
+// broker not supporting it skips, e.g.
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, func() broker.Broker {
+//			return NewBroker(broker.Addrs(addr))
+//		}, conformance.Skip(conformance.AckRedelivery, "no acks"))
+//	}
+package conformance
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/pborman/uuid"
+)
+
+// Case is a behaviour checked by the suite.
+type Case string
+
+const (
+	// HeaderRoundTrip checks that the message headers
+	// and body are received as published.
+	HeaderRoundTrip Case = "HeaderRoundTrip"
+	// CompetingConsumers checks that each message published is
+	// handled by a single subscriber of a Queue.
+	CompetingConsumers Case = "CompetingConsumers"
+	// UnsubscribeIsolation checks that Unsubscribe only stops the
+	// subscriber it is called on, not others of the same topic.
+	UnsubscribeIsolation Case = "UnsubscribeIsolation"
+	// Reconnect checks that the broker can connect
+	// again once disconnected.
+	Reconnect Case = "Reconnect"
+	// AckRedelivery checks that a message which isn't acked by the
+	// handler, with AutoAck disabled, is delivered again.
+	AckRedelivery Case = "AckRedelivery"
+)
+
+var (
+	// Cases are all the cases in the order they are run.
+	Cases = []Case{
+		HeaderRoundTrip,
+		CompetingConsumers,
+		UnsubscribeIsolation,
+		Reconnect,
+		AckRedelivery,
+	}
+
+	// DefaultTimeout is how long to wait for a message.
+	DefaultTimeout = 10 * time.Second
+	// DefaultTopic is the prefix of the topics used.
+	DefaultTopic = "go.micro.conformance"
+)
+
+// Options of the suite.
+type Options struct {
+	// Reasons of the cases skipped
+	Skip map[Case]string
+	// Timeout waiting for a message
+	Timeout time.Duration
+	// Settle is the time to wait after subscribing
+	// before publishing, for subscriptions which
+	// are established asynchronously
+	Settle time.Duration
+	// Topic is the prefix of the topics used
+	Topic string
+	// SubscribeOptions are passed to every Subscribe
+	SubscribeOptions []broker.SubscribeOption
+	// Redeliver triggers the redelivery of unacked
+	// messages for brokers which don't redeliver
+	// on their own
+	Redeliver func(broker.Broker) error
+}
+
+// Option sets an option of the suite.
+type Option func(*Options)
+
+// Skip skips the case, the reason being logged.
+func Skip(c Case, reason string) Option {
+	return func(o *Options) {
+		o.Skip[c] = reason
+	}
+}
+
+// Timeout sets how long to wait for a message.
+func Timeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// Settle sets the time to wait after subscribing before publishing.
+func Settle(d time.Duration) Option {
+	return func(o *Options) {
+		o.Settle = d
+	}
+}
+
+// Topic sets the prefix of the topics used.
+func Topic(prefix string) Option {
+	return func(o *Options) {
+		o.Topic = prefix
+	}
+}
+
+// SubscribeOptions are passed to every Subscribe of the suite.
+func SubscribeOptions(opts ...broker.SubscribeOption) Option {
+	return func(o *Options) {
+		o.SubscribeOptions = append(o.SubscribeOptions, opts...)
+	}
+}
+
+// Redeliver sets the func triggering the redelivery of unacked messages.
+func Redeliver(fn func(broker.Broker) error) Option {
+	return func(o *Options) {
+		o.Redeliver = fn
+	}
+}
+
+// Run runs every case as a subtest named after it against a new
+// broker returned by fn. The broker is connected by the case.
+func Run(t *testing.T, fn func() broker.Broker, opts ...Option) {
+	options := Options{
+		Skip:    make(map[Case]string),
+		Timeout: DefaultTimeout,
+		Topic:   DefaultTopic,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	cases := map[Case]func(*testing.T, *suite){
+		HeaderRoundTrip:      testHeaderRoundTrip,
+		CompetingConsumers:   testCompetingConsumers,
+		UnsubscribeIsolation: testUnsubscribeIsolation,
+		Reconnect:            testReconnect,
+		AckRedelivery:        testAckRedelivery,
+	}
+
+	for _, c := range Cases {
+		c := c
+		t.Run(string(c), func(t *testing.T) {
+			if reason, ok := options.Skip[c]; ok {
+				t.Skip(reason)
+			}
+
+			s := &suite{
+				opts:  options,
+				topic: fmt.Sprintf("%s.%s", options.Topic, uuid.NewUUID().String()),
+				b:     fn(),
+			}
+
+			if err := s.b.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.b.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.b.Disconnect()
+
+			cases[c](t, s)
+		})
+	}
+}
+
+// suite is the state of a single case
+type suite struct {
+	opts  Options
+	topic string
+	b     broker.Broker
+}
+
+func (s *suite) subscribe(t *testing.T, h broker.Handler, opts ...broker.SubscribeOption) broker.Subscriber {
+	opts = append(append([]broker.SubscribeOption{}, s.opts.SubscribeOptions...), opts...)
+	sub, err := s.b.Subscribe(s.topic, h, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func (s *suite) publish(t *testing.T, msg *broker.Message) {
+	if err := s.b.Publish(s.topic, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *suite) settle() {
+	if s.opts.Settle > 0 {
+		time.Sleep(s.opts.Settle)
+	}
+}
+
+// receive waits for a message on the channel
+func (s *suite) receive(t *testing.T, ch <-chan *broker.Message) *broker.Message {
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(s.opts.Timeout):
+		t.Fatalf("timed out waiting for a message after %v", s.opts.Timeout)
+	}
+	return nil
+}
+
+// none checks no message is received on the channel within
+// the settle time, or a second if it isn't set
+func (s *suite) none(t *testing.T, ch <-chan *broker.Message) {
+	d := s.opts.Settle
+	if d == 0 {
+		d = time.Second
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("unexpected message %s", string(m.Body))
+	case <-time.After(d):
+	}
+}
+
+func handle(ch chan<- *broker.Message) broker.Handler {
+	return func(p broker.Publication) error {
+		ch <- p.Message()
+		return nil
+	}
+}
+
+func testHeaderRoundTrip(t *testing.T, s *suite) {
+	ch := make(chan *broker.Message, 1)
+	sub := s.subscribe(t, handle(ch))
+	defer sub.Unsubscribe()
+	s.settle()
+
+	msg := &broker.Message{
+		Header: map[string]string{
+			"Content-Type": "application/octet-stream",
+			"X-Message-Id": uuid.NewUUID().String(),
+		},
+		Body: []byte("hello world"),
+	}
+	s.publish(t, msg)
+
+	m := s.receive(t, ch)
+
+	for k, v := range msg.Header {
+		if m.Header[k] != v {
+			t.Errorf("expected header %s to be %q, got %q", k, v, m.Header[k])
+		}
+	}
+
+	if string(m.Body) != string(msg.Body) {
+		t.Errorf("expected body %q, got %q", string(msg.Body), string(m.Body))
+	}
+}
+
+func testCompetingConsumers(t *testing.T, s *suite) {
+	n := 10
+	ch := make(chan *broker.Message, 2*n)
+	queue := broker.Queue(uuid.NewUUID().String())
+
+	for i := 0; i < 2; i++ {
+		sub := s.subscribe(t, handle(ch), queue)
+		defer sub.Unsubscribe()
+	}
+	s.settle()
+
+	for i := 0; i < n; i++ {
+		s.publish(t, &broker.Message{Body: []byte(fmt.Sprintf("%d", i))})
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		m := s.receive(t, ch)
+		if seen[string(m.Body)] {
+			t.Fatalf("message %s handled more than once", string(m.Body))
+		}
+		seen[string(m.Body)] = true
+	}
+
+	s.none(t, ch)
+}
+
+func testUnsubscribeIsolation(t *testing.T, s *suite) {
+	ch1 := make(chan *broker.Message, 1)
+	ch2 := make(chan *broker.Message, 1)
+
+	sub1 := s.subscribe(t, handle(ch1))
+	sub2 := s.subscribe(t, handle(ch2))
+	defer sub2.Unsubscribe()
+	s.settle()
+
+	if err := sub1.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.publish(t, &broker.Message{Body: []byte("hello")})
+
+	if m := s.receive(t, ch2); string(m.Body) != "hello" {
+		t.Fatalf("expected hello, got %s", string(m.Body))
+	}
+
+	s.none(t, ch1)
+}
+
+func testReconnect(t *testing.T, s *suite) {
+	if err := s.b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *broker.Message, 1)
+	sub := s.subscribe(t, handle(ch))
+	defer sub.Unsubscribe()
+	s.settle()
+
+	s.publish(t, &broker.Message{Body: []byte("hello")})
+
+	if m := s.receive(t, ch); string(m.Body) != "hello" {
+		t.Fatalf("expected hello, got %s", string(m.Body))
+	}
+}
+
+func testAckRedelivery(t *testing.T, s *suite) {
+	ch := make(chan *broker.Message, 2)
+
+	var mtx sync.Mutex
+	var deliveries int
+
+	sub := s.subscribe(t, func(p broker.Publication) error {
+		mtx.Lock()
+		deliveries++
+		first := deliveries == 1
+		mtx.Unlock()
+
+		ch <- p.Message()
+
+		// neither acked nor handled the first time
+		if first {
+			return fmt.Errorf("not handled")
+		}
+		return p.Ack()
+	}, broker.DisableAutoAck(), broker.Queue(uuid.NewUUID().String()))
+	defer sub.Unsubscribe()
+	s.settle()
+
+	s.publish(t, &broker.Message{Body: []byte("hello")})
+
+	if m := s.receive(t, ch); string(m.Body) != "hello" {
+		t.Fatalf("expected hello, got %s", string(m.Body))
+	}
+
+	if s.opts.Redeliver != nil {
+		if err := s.opts.Redeliver(s.b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m := s.receive(t, ch); string(m.Body) != "hello" {
+		t.Fatalf("expected hello to be redelivered, got %s", string(m.Body))
+	}
+}
@@ -0,0 +1,21 @@
+package googlepubsub
+
+import (
+	"os"
+	"testing"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(ProjectID("conformance"))
+	},
+		conformance.Skip(conformance.Reconnect, "Disconnect closes the client for good"),
+	)
+}
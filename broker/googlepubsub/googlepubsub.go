@@ -5,6 +5,13 @@ package googlepubsub
 */
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub"
@@ -13,11 +20,18 @@ import (
 	"github.com/pborman/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 )
 
 type pubsubBroker struct {
 	client  *pubsub.Client
 	options broker.Options
+
+	sync.Mutex
+	// topic handles of the publishers, each runs its own bundler
+	topics map[string]*pubsub.Topic
+	// handles with message ordering, used for messages with an ordering key
+	ordered map[string]*pubsub.Topic
 }
 
 // A pubsub subscriber that manages handling of messages
@@ -26,6 +40,8 @@ type subscriber struct {
 	topic   string
 	exit    chan bool
 	sub     *pubsub.Subscription
+	// delete the subscription on unsubscribe
+	del bool
 }
 
 // A single publication received by a handler
@@ -40,47 +56,55 @@ func init() {
 }
 
 func (s *subscriber) run(hdlr broker.Handler) {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-s.exit
+		cancel()
+	}()
+
 	for {
+		// blocks until the context is cancelled or
+		// an unrecoverable error occurred
+		err := s.sub.Receive(ctx, func(ctx context.Context, pm *pubsub.Message) {
+			// create broker message
+			m := &broker.Message{
+				Header: pm.Attributes,
+				Body:   pm.Data,
+			}
+
+			// create publication
+			p := &publication{
+				pm:    pm,
+				m:     m,
+				topic: s.topic,
+			}
+
+			// redeliver on error
+			if err := hdlr(p); err != nil {
+				pm.Nack()
+				return
+			}
+
+			// auto ack?
+			if s.options.AutoAck {
+				p.Ack()
+			}
+		})
+
 		select {
 		case <-s.exit:
 			return
 		default:
-			iter, err := s.sub.Pull(ctx)
-			if err != nil {
-				time.Sleep(time.Second)
-				continue
-			}
-			defer iter.Stop()
-
-			// iterate over the messages
-			for {
-				pm, err := iter.Next()
-				if err != nil {
-					break
-				}
-
-				// create broker message
-				m := &broker.Message{
-					Header: pm.Attributes,
-					Body:   pm.Data,
-				}
-
-				// create publication
-				p := &publication{
-					pm:    pm,
-					m:     m,
-					topic: s.topic,
-				}
-
-				// If the error is nil lets check if we should auto ack
-				if err := hdlr(p); err == nil {
-					// auto ack?
-					if s.options.AutoAck {
-						p.Ack()
-					}
-				}
-			}
+		}
+
+		// retry after a second
+		log.Println("googlepubsub: receive error:", err)
+
+		select {
+		case <-s.exit:
+			return
+		case <-time.After(time.Second):
 		}
 	}
 }
@@ -99,13 +123,15 @@ func (s *subscriber) Unsubscribe() error {
 		return nil
 	default:
 		close(s.exit)
+		if !s.del {
+			return nil
+		}
 		return s.sub.Delete(context.Background())
 	}
-	return nil
 }
 
 func (p *publication) Ack() error {
-	p.pm.Done(true)
+	p.pm.Ack()
 	return nil
 }
 
@@ -125,7 +151,19 @@ func (b *pubsubBroker) Connect() error {
 	return nil
 }
 
+// Disconnect flushes and stops the topic handles and closes the client
 func (b *pubsubBroker) Disconnect() error {
+	b.Lock()
+	for _, t := range b.topics {
+		t.Stop()
+	}
+	for _, t := range b.ordered {
+		t.Stop()
+	}
+	b.topics = make(map[string]*pubsub.Topic)
+	b.ordered = make(map[string]*pubsub.Topic)
+	b.Unlock()
+
 	return b.client.Close()
 }
 
@@ -138,66 +176,208 @@ func (b *pubsubBroker) Options() broker.Options {
 	return b.options
 }
 
-// Publish checks if the topic exists and then publishes via google pubsub
-func (b *pubsubBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
-	t := b.client.Topic(topic)
-	ctx := context.Background()
+// topic returns the handle of the topic, creating the topic if it
+// doesn't exist. The handle is kept for later publications.
+func (b *pubsubBroker) topic(ctx context.Context, name string) (*pubsub.Topic, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
+
+	t := b.client.Topic(name)
 
 	exists, err := t.Exists(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !exists {
-		tt, err := b.client.CreateTopic(ctx, topic)
+		tt, err := b.client.CreateTopic(ctx, name)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		t = tt
 	}
 
+	b.topics[name] = t
+	return t, nil
+}
+
+// orderedTopic returns a handle of the topic with message ordering
+// enabled. It is kept apart from the plain handle as ordering has to
+// be enabled before the first publication and slows down publishing.
+func (b *pubsubBroker) orderedTopic(ctx context.Context, name string) (*pubsub.Topic, error) {
+	// make sure the topic exists
+	if _, err := b.topic(ctx, name); err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if t, ok := b.ordered[name]; ok {
+		return t, nil
+	}
+
+	t := b.client.Topic(name)
+	t.EnableMessageOrdering = true
+
+	b.ordered[name] = t
+	return t, nil
+}
+
+// Publish checks if the topic exists and then publishes via google pubsub
+func (b *pubsubBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	ctx := context.Background()
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
 	m := &pubsub.Message{
 		ID:         uuid.NewUUID().String(),
 		Data:       msg.Body,
 		Attributes: msg.Header,
 	}
 
-	_, err = t.Publish(ctx, m)
+	if options.Context != nil {
+		if attrs, ok := options.Context.Value(attributesKey{}).(map[string]string); ok {
+			m.Attributes = make(map[string]string, len(msg.Header)+len(attrs))
+			for k, v := range msg.Header {
+				m.Attributes[k] = v
+			}
+			for k, v := range attrs {
+				m.Attributes[k] = v
+			}
+		}
+		if key, ok := options.Context.Value(orderingKeyKey{}).(string); ok {
+			m.OrderingKey = key
+		}
+	}
+
+	var t *pubsub.Topic
+	var err error
+	if len(m.OrderingKey) > 0 {
+		t, err = b.orderedTopic(ctx, topic)
+	} else {
+		t, err = b.topic(ctx, topic)
+	}
+	if err != nil {
+		return err
+	}
+
+	// wait for the message to be sent
+	_, err = t.Publish(ctx, m).Get(ctx)
+	if err != nil && len(m.OrderingKey) > 0 {
+		// publishing of the key is paused on the handle after an error
+		t.ResumePublish(m.OrderingKey)
+	}
 	return err
 }
 
+// validName matches the subscription names accepted by google pubsub
+var validName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-_.~+%]{2,254}$`)
+
+// subscriptionName derives the name of the subscription from
+// the topic and the queue, as names are unique per project.
+// Names which google pubsub would reject are replaced by a hash.
+func subscriptionName(topic, queue string) string {
+	name := topic + "-" + queue
+	if validName.MatchString(name) && !strings.HasPrefix(name, "goog") {
+		return name
+	}
+	h := sha256.Sum256([]byte(topic + "\x00" + queue))
+	return "sub-" + hex.EncodeToString(h[:])
+}
+
 // Subscribe registers a subscription to the given topic against the google pubsub api
 func (b *pubsubBroker) Subscribe(topic string, h broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
 	options := broker.SubscribeOptions{
 		AutoAck: true,
-		Queue:   uuid.NewUUID().String(),
 	}
 
 	for _, o := range opts {
 		o(&options)
 	}
 
+	// subscriptions of a queue are kept by default
+	queue := options.Queue
+	del := len(queue) == 0
+	if del {
+		queue = uuid.NewUUID().String()
+	}
+
+	var ordering bool
+	if options.Context != nil {
+		if d, ok := options.Context.Value(deleteSubscriptionKey{}).(bool); ok {
+			del = d
+		}
+		ordering, _ = options.Context.Value(messageOrderingKey{}).(bool)
+	}
+
 	ctx := context.Background()
-	sub := b.client.Subscription(options.Queue)
-	exists, err := sub.Exists(ctx)
-	if err != nil {
-		return nil, err
+
+	var sub *pubsub.Subscription
+	var exists bool
+	var err error
+
+	// subscriptions used to be named after the queue alone,
+	// keep using those so that no messages are lost
+	if len(options.Queue) > 0 {
+		sub = b.client.Subscription(options.Queue)
+		exists, err = sub.Exists(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !exists {
+		name := subscriptionName(topic, queue)
+		sub = b.client.Subscription(name)
+		exists, err = sub.Exists(ctx)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if !exists {
-		tt := b.client.Topic(topic)
-		subb, err := b.client.CreateSubscription(ctx, options.Queue, tt, time.Duration(0), nil)
+		// the topic may not have been published to yet
+		tt, err := b.topic(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+		subb, err := b.client.CreateSubscription(ctx, sub.ID(), pubsub.SubscriptionConfig{
+			Topic:                 tt,
+			EnableMessageOrdering: ordering,
+		})
 		if err != nil {
 			return nil, err
 		}
 		sub = subb
 	}
 
+	// flow control
+	if options.Context != nil {
+		if n, ok := options.Context.Value(maxOutstandingMessagesKey{}).(int); ok {
+			sub.ReceiveSettings.MaxOutstandingMessages = n
+		}
+		if n, ok := options.Context.Value(maxOutstandingBytesKey{}).(int); ok {
+			sub.ReceiveSettings.MaxOutstandingBytes = n
+		}
+		if d, ok := options.Context.Value(maxExtensionKey{}).(time.Duration); ok {
+			sub.ReceiveSettings.MaxExtension = d
+		}
+	}
+
 	subscriber := &subscriber{
 		options: options,
 		topic:   topic,
 		exit:    make(chan bool),
 		sub:     sub,
+		del:     del,
 	}
 
 	go subscriber.run(h)
@@ -224,6 +404,15 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 	// retrieve client opts
 	cOpts, _ := options.Context.Value(clientOptionKey{}).([]option.ClientOption)
 
+	// use the emulator if set
+	if addr := os.Getenv("PUBSUB_EMULATOR_HOST"); len(addr) > 0 {
+		cOpts = append(cOpts,
+			option.WithEndpoint(addr),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+			option.WithoutAuthentication(),
+		)
+	}
+
 	// create pubsub client
 	c, err := pubsub.NewClient(context.Background(), prjID, cOpts...)
 	if err != nil {
@@ -233,5 +422,7 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 	return &pubsubBroker{
 		client:  c,
 		options: options,
+		topics:  make(map[string]*pubsub.Topic),
+		ordered: make(map[string]*pubsub.Topic),
 	}
 }
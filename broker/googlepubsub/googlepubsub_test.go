@@ -0,0 +1,37 @@
+package googlepubsub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubscriptionName(t *testing.T) {
+	testcases := []struct {
+		name  string
+		topic string
+		queue string
+		hash  bool
+	}{
+		{"plain", "events", "workers", false},
+		{"too long", "events", strings.Repeat("q", 255), true},
+		{"invalid character", "events", "work/ers", true},
+		{"invalid start", "1events", "workers", true},
+		{"reserved prefix", "google", "workers", true},
+	}
+
+	for _, test := range testcases {
+		name := subscriptionName(test.topic, test.queue)
+		if !test.hash && name != test.topic+"-"+test.queue {
+			t.Errorf("%s: expected %s-%s, got %s", test.name, test.topic, test.queue, name)
+		}
+		if test.hash && !strings.HasPrefix(name, "sub-") {
+			t.Errorf("%s: expected a hashed name, got %s", test.name, name)
+		}
+		if !validName.MatchString(name) {
+			t.Errorf("%s: invalid subscription name %s", test.name, name)
+		}
+		if name != subscriptionName(test.topic, test.queue) {
+			t.Errorf("%s: expected a stable name", test.name)
+		}
+	}
+}
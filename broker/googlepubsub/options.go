@@ -1,6 +1,8 @@
 package googlepubsub
 
 import (
+	"time"
+
 	"github.com/micro/go-micro/broker"
 	"golang.org/x/net/context"
 	"google.golang.org/api/option"
@@ -10,6 +12,20 @@ type clientOptionKey struct{}
 
 type projectIDKey struct{}
 
+type maxOutstandingMessagesKey struct{}
+
+type maxOutstandingBytesKey struct{}
+
+type maxExtensionKey struct{}
+
+type deleteSubscriptionKey struct{}
+
+type messageOrderingKey struct{}
+
+type orderingKeyKey struct{}
+
+type attributesKey struct{}
+
 // ClientOption is a broker Option which allows google pubsub client options to be
 // set for the client
 func ClientOption(c ...option.ClientOption) broker.Option {
@@ -30,3 +46,83 @@ func ProjectID(id string) broker.Option {
 		o.Context = context.WithValue(o.Context, projectIDKey{}, id)
 	}
 }
+
+// MaxOutstandingMessages sets the maximum number of messages
+// received but not yet acknowledged by the subscriber
+func MaxOutstandingMessages(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxOutstandingMessagesKey{}, n)
+	}
+}
+
+// MaxOutstandingBytes sets the maximum size of the messages
+// received but not yet acknowledged by the subscriber
+func MaxOutstandingBytes(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxOutstandingBytesKey{}, n)
+	}
+}
+
+// MaxExtension sets how long the ack deadline of a message
+// is extended while its handler is running
+func MaxExtension(d time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxExtensionKey{}, d)
+	}
+}
+
+// DeleteSubscription sets whether Unsubscribe deletes the google pubsub
+// subscription. By default subscriptions with a queue are kept, so the
+// queue resumes where it left off, and all others are deleted.
+func DeleteSubscription(del bool) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, deleteSubscriptionKey{}, del)
+	}
+}
+
+// MessageOrdering creates the subscription with message ordering enabled,
+// so messages with the same ordering key are delivered in order. It has
+// no effect on existing subscriptions.
+func MessageOrdering() broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, messageOrderingKey{}, true)
+	}
+}
+
+// OrderingKey publishes the message with an ordering key. Messages
+// with the same key are delivered in order to subscriptions which
+// have MessageOrdering enabled.
+func OrderingKey(key string) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, orderingKeyKey{}, key)
+	}
+}
+
+// Attributes adds attributes to the published message, overriding
+// message headers of the same name
+func Attributes(attrs map[string]string) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, attributesKey{}, attrs)
+	}
+}
@@ -0,0 +1,28 @@
+package kafka
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("KAFKA_ADDR")
+	if addr == "" {
+		t.Skip("KAFKA_ADDR not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(broker.Addrs(addr))
+	},
+		// topics are new, read them from the start
+		// as the group may join after publishing
+		conformance.SubscribeOptions(InitialOffset(sarama.OffsetOldest)),
+		conformance.Skip(conformance.AckRedelivery, "unacked messages are only redelivered to the next consumer of the group after a rebalance"),
+		conformance.Settle(5*time.Second),
+	)
+}
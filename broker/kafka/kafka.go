@@ -6,7 +6,12 @@ package kafka
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/micro/go-micro/broker"
@@ -20,8 +25,16 @@ type kBroker struct {
 
 	c  sarama.Client
 	p  sarama.SyncProducer
+	ap sarama.AsyncProducer
 	sc *sc.Client
 
+	// sync producer of the dead letters in async producer mode
+	sync.Mutex
+	dp sarama.SyncProducer
+
+	// waits for the async producer reports to be drained
+	wg sync.WaitGroup
+
 	opts broker.Options
 }
 
@@ -29,6 +42,20 @@ type subscriber struct {
 	s    *sc.Consumer
 	t    string
 	opts broker.SubscribeOptions
+
+	// retry and dead letter settings
+	retries    int
+	backoff    time.Duration
+	deadLetter string
+
+	// set while the handler runs, Unsubscribe
+	// can't wait for it if called by the handler
+	handling int32
+
+	once sync.Once
+	exit chan bool
+	done chan bool
+	err  error
 }
 
 type publication struct {
@@ -63,8 +90,99 @@ func (s *subscriber) Topic() string {
 	return s.t
 }
 
+// Unsubscribe waits for the message being handled, if any, and
+// closes the consumer which commits the marked offsets. While a
+// message is being handled, e.g. when called by the handler, it
+// returns at once and the consumer is closed once the handler returned.
 func (s *subscriber) Unsubscribe() error {
-	return s.s.Close()
+	s.once.Do(func() {
+		close(s.exit)
+	})
+	if atomic.LoadInt32(&s.handling) == 1 {
+		return nil
+	}
+	<-s.done
+	return s.err
+}
+
+func (s *subscriber) run(k *kBroker, handler broker.Handler, rebalance func(claimed, released map[string][]int32)) {
+	defer func() {
+		s.err = s.s.Close()
+		close(s.done)
+	}()
+
+	c := s.s
+
+	for {
+		select {
+		case <-s.exit:
+			return
+		case err, ok := <-c.Errors():
+			if !ok {
+				return
+			}
+			log.Println("consumer error:", err)
+		case n, ok := <-c.Notifications():
+			if !ok {
+				return
+			}
+			rebalance(n.Claimed, n.Released)
+		case sm, ok := <-c.Messages():
+			if !ok {
+				return
+			}
+			m, err := k.decode(sm)
+			if err != nil {
+				continue
+			}
+			p := &publication{
+				m:  m,
+				t:  sm.Topic,
+				c:  c,
+				km: sm,
+			}
+			atomic.StoreInt32(&s.handling, 1)
+			n, err := s.handle(handler, p)
+			atomic.StoreInt32(&s.handling, 0)
+			if err == nil {
+				if s.opts.AutoAck {
+					c.MarkOffset(sm, "")
+				}
+				continue
+			}
+			select {
+			case <-s.exit:
+				// retries were interrupted, leave the
+				// message to the next consumer
+				return
+			default:
+			}
+			if len(s.deadLetter) == 0 {
+				continue
+			}
+			if err := k.deadLetter(s.deadLetter, sm, m, n, err); err != nil {
+				log.Println("dead letter error:", err)
+				continue
+			}
+			c.MarkOffset(sm, "")
+		}
+	}
+}
+
+// handle runs the handler and retries it with backoff on error.
+// It returns the number of retries and the last error.
+func (s *subscriber) handle(handler broker.Handler, p *publication) (int, error) {
+	err := handler(p)
+	i := 0
+	for ; err != nil && i < s.retries; i++ {
+		select {
+		case <-s.exit:
+			return i, err
+		case <-time.After(s.backoff << uint(i)):
+		}
+		err = handler(p)
+	}
+	return i, err
 }
 
 func (k *kBroker) Address() string {
@@ -79,47 +197,385 @@ func (k *kBroker) Connect() error {
 		return nil
 	}
 
-	c, err := sarama.NewClient(k.addrs, sarama.NewConfig())
+	c, err := sarama.NewClient(k.addrs, k.getBrokerConfig())
 	if err != nil {
 		return err
 	}
 
-	k.c = c
+	var p sarama.SyncProducer
+	var ap sarama.AsyncProducer
+
+	if opts := k.asyncProducer(); opts != nil {
+		ap, err = sarama.NewAsyncProducerFromClient(c)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		k.report(ap, opts)
+	} else {
+		p, err = sarama.NewSyncProducerFromClient(c)
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
 
-	p, err := sarama.NewSyncProducerFromClient(c)
+	cs, err := sc.NewClient(k.addrs, k.getClusterConfig())
 	if err != nil {
+		if ap != nil {
+			// closes the report channels
+			ap.Close()
+			k.wg.Wait()
+		}
+		if p != nil {
+			p.Close()
+		}
+		c.Close()
 		return err
 	}
 
+	// only set once connected, Connect is retried otherwise
+	k.c = c
 	k.p = p
+	k.ap = ap
+	k.sc = cs
+	return nil
+}
+
+// setSecurity applies the TLS and SASL settings of the broker
+// to both the producer and the consumer client config.
+func (k *kBroker) setSecurity(config *sarama.Config) {
+	// secure might not be set
+	if k.opts.Secure || k.opts.TLSConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = k.opts.TLSConfig
+	}
+
+	if k.opts.Context == nil {
+		return
+	}
+
+	auth, ok := k.opts.Context.Value(saslKey{}).(*saslAuth)
+	if !ok {
+		return
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = auth.mechanism
+	config.Net.SASL.User = auth.user
+	config.Net.SASL.Password = auth.password
 
+	// the sasl handshake requires kafka 0.10
+	setMinVersion(config, sarama.V0_10_0_0)
+
+	switch auth.mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256Fn}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512Fn}
+		}
+	}
+}
+
+// report forwards the delivery reports of the async producer
+func (k *kBroker) report(p sarama.AsyncProducer, ap *asyncProducer) {
+	k.wg.Add(2)
+
+	go func() {
+		defer k.wg.Done()
+		for err := range p.Errors() {
+			if ap.errors == nil {
+				log.Println("producer error:", err)
+				continue
+			}
+			ap.errors <- err
+		}
+	}()
+
+	go func() {
+		defer k.wg.Done()
+		for msg := range p.Successes() {
+			ap.successes <- msg
+		}
+	}()
+}
+
+func (k *kBroker) asyncProducer() *asyncProducer {
+	if k.opts.Context == nil {
+		return nil
+	}
+	ap, _ := k.opts.Context.Value(asyncProducerKey{}).(*asyncProducer)
+	return ap
+}
+
+// setProducer applies the producer settings of the broker
+func (k *kBroker) setProducer(config *sarama.Config) {
+	ap := k.asyncProducer()
+
+	// the sync producer relies on success reports
+	config.Producer.Return.Successes = ap == nil || ap.successes != nil
+	config.Producer.Return.Errors = true
+
+	if k.opts.Context == nil {
+		return
+	}
+
+	if n, ok := k.opts.Context.Value(batchSizeKey{}).(int); ok {
+		config.Producer.Flush.Messages = n
+	}
+	if d, ok := k.opts.Context.Value(lingerKey{}).(time.Duration); ok {
+		config.Producer.Flush.Frequency = d
+	}
+	if c, ok := k.opts.Context.Value(compressionKey{}).(sarama.CompressionCodec); ok {
+		config.Producer.Compression = c
+	}
+	if a, ok := k.opts.Context.Value(requiredAcksKey{}).(sarama.RequiredAcks); ok {
+		config.Producer.RequiredAcks = a
+	}
+}
+
+func (k *kBroker) getBrokerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	k.setSecurity(config)
+	k.setProducer(config)
+	if k.nativeMessages() {
+		// record headers require kafka 0.11
+		setMinVersion(config, sarama.V0_11_0_0)
+	}
+	return config
+}
+
+func (k *kBroker) getClusterConfig() *sc.Config {
 	config := sc.NewConfig()
-	// TODO: make configurable offset as SubscriberOption
-	config.Config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	config.Config.Consumer.Offsets.Initial = DefaultInitialOffset
+	k.setSecurity(&config.Config)
+	if k.nativeMessages() {
+		setMinVersion(&config.Config, sarama.V0_11_0_0)
+	}
+	return config
+}
+
+func (k *kBroker) nativeMessages() bool {
+	if k.opts.Context == nil {
+		return false
+	}
+	native, _ := k.opts.Context.Value(nativeMessagesKey{}).(bool)
+	return native
+}
+
+// encode creates the producer message for the broker message
+func (k *kBroker) encode(topic string, msg *broker.Message, opts broker.PublishOptions) (*sarama.ProducerMessage, error) {
+	pm := &sarama.ProducerMessage{
+		Topic: topic,
+	}
+
+	if k.nativeMessages() {
+		pm.Value = sarama.ByteEncoder(msg.Body)
+		for hk, hv := range msg.Header {
+			pm.Headers = append(pm.Headers, sarama.RecordHeader{
+				Key:   []byte(hk),
+				Value: []byte(hv),
+			})
+		}
+	} else {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		pm.Value = sarama.ByteEncoder(b)
+	}
+
+	if key := partitionKey(msg, opts); len(key) > 0 {
+		pm.Key = sarama.StringEncoder(key)
+	}
 
-	cs, err := sc.NewClient(k.addrs, config)
+	return pm, nil
+}
+
+// decode creates the broker message for the consumer message
+func (k *kBroker) decode(sm *sarama.ConsumerMessage) (*broker.Message, error) {
+	if !k.nativeMessages() {
+		var m *broker.Message
+		if err := json.Unmarshal(sm.Value, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	header := make(map[string]string, len(sm.Headers))
+	for _, h := range sm.Headers {
+		header[string(h.Key)] = string(h.Value)
+	}
+
+	return &broker.Message{
+		Header: header,
+		Body:   sm.Value,
+	}, nil
+}
+
+// deadLetter publishes a copy of the failed message
+// with the error metadata to the dead letter topic
+func (k *kBroker) deadLetter(topic string, sm *sarama.ConsumerMessage, m *broker.Message, retries int, err error) error {
+	var options broker.PublishOptions
+	if len(sm.Key) > 0 {
+		PartitionKey(string(sm.Key))(&options)
+	}
+
+	pm, err := k.encode(topic, deadLetterMessage(sm, m, retries, err), options)
 	if err != nil {
 		return err
 	}
 
-	k.sc = cs
-	// TODO: TLS
-	/*
-		opts.Secure = k.opts.Secure
-		opts.TLSConfig = k.opts.TLSConfig
+	p, err := k.deadLetterProducer()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = p.SendMessage(pm)
+	return err
+}
+
+// deadLetterMessage returns a copy of the failed message with the
+// error, the origin of the message and the number of retries as headers
+func deadLetterMessage(sm *sarama.ConsumerMessage, m *broker.Message, retries int, err error) *broker.Message {
+	header := make(map[string]string, len(m.Header)+5)
+	for hk, hv := range m.Header {
+		header[hk] = hv
+	}
+	header[ErrorHeader] = err.Error()
+	header[TopicHeader] = sm.Topic
+	header[PartitionHeader] = strconv.FormatInt(int64(sm.Partition), 10)
+	header[OffsetHeader] = strconv.FormatInt(sm.Offset, 10)
+	header[RetriesHeader] = strconv.Itoa(retries)
+
+	return &broker.Message{
+		Header: header,
+		Body:   m.Body,
+	}
+}
+
+// deadLetterProducer returns the producer of the dead letters. The offset
+// of the failed message is marked once the dead letter is sent, which the
+// async producer doesn't tell, so it gets a sync producer of its own.
+func (k *kBroker) deadLetterProducer() (sarama.SyncProducer, error) {
+	if k.ap == nil {
+		return k.p, nil
+	}
 
-		// secure might not be set
-		if k.opts.TLSConfig != nil {
-			opts.Secure = true
+	k.Lock()
+	defer k.Unlock()
+
+	if k.dp == nil {
+		config := k.getBrokerConfig()
+		config.Producer.Return.Successes = true
+		p, err := sarama.NewSyncProducer(k.addrs, config)
+		if err != nil {
+			return nil, err
+		}
+		k.dp = p
+	}
+
+	return k.dp, nil
+}
+
+func partitionKey(msg *broker.Message, opts broker.PublishOptions) string {
+	if opts.Context == nil {
+		return ""
+	}
+	if key, ok := opts.Context.Value(partitionKeyKey{}).(string); ok {
+		return key
+	}
+	if name, ok := opts.Context.Value(partitionKeyHeaderKey{}).(string); ok {
+		return msg.Header[name]
+	}
+	return ""
+}
+
+func setMinVersion(config *sarama.Config, version sarama.KafkaVersion) {
+	if !config.Version.IsAtLeast(version) {
+		config.Version = version
+	}
+}
+
+// seek commits the given offsets for the consumer group so that
+// a consumer joining the group starts reading from them.
+func (k *kBroker) seek(group, topic string, offsets map[int32]int64) error {
+	om, err := sarama.NewOffsetManagerFromClient(group, k.c)
+	if err != nil {
+		return err
+	}
+	defer om.Close()
+
+	for partition, offset := range offsets {
+		pom, err := om.ManagePartition(topic, partition)
+		if err != nil {
+			return err
 		}
-	*/
+		pom.ResetOffset(offset, "")
+		if err := pom.Close(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// timeOffsets resolves the offset of the first message at or after t
+// for every partition of the topic.
+func (k *kBroker) timeOffsets(topic string, t time.Time) (map[int32]int64, error) {
+	partitions, err := k.c.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		offset, err := k.c.GetOffset(topic, partition, t.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		// no message after t, start at the end of the partition
+		if offset == sarama.OffsetNewest {
+			offset, err = k.c.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, err
+			}
+		}
+		offsets[partition] = offset
+	}
+
+	return offsets, nil
+}
+
+// Disconnect closes the clients and producer,
+// Connect creates new ones
 func (k *kBroker) Disconnect() error {
+	if k.c == nil {
+		return nil
+	}
 	k.sc.Close()
-	k.p.Close()
-	return k.c.Close()
+	if k.ap != nil {
+		// flushes in-flight messages and closes the report channels
+		k.ap.Close()
+		k.wg.Wait()
+		k.Lock()
+		if k.dp != nil {
+			k.dp.Close()
+			k.dp = nil
+		}
+		k.Unlock()
+	} else {
+		k.p.Close()
+	}
+	err := k.c.Close()
+	k.c = nil
+	k.sc = nil
+	k.p = nil
+	k.ap = nil
+	return err
 }
 
 func (k *kBroker) Init(opts ...broker.Option) error {
@@ -134,18 +590,33 @@ func (k *kBroker) Options() broker.Options {
 }
 
 func (k *kBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
-	b, err := json.Marshal(msg)
+	if k.c == nil {
+		return errors.New("not connected")
+	}
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	pm, err := k.encode(topic, msg, options)
 	if err != nil {
 		return err
 	}
-	_, _, err = k.p.SendMessage(&sarama.ProducerMessage{
-		Topic: topic,
-		Value: sarama.ByteEncoder(b),
-	})
+	if k.ap != nil {
+		k.ap.Input() <- pm
+		return nil
+	}
+
+	_, _, err = k.p.SendMessage(pm)
 	return err
 }
 
 func (k *kBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if k.c == nil {
+		return nil, errors.New("not connected")
+	}
+
 	opt := broker.SubscribeOptions{
 		AutoAck: true,
 		Queue:   uuid.NewUUID().String(),
@@ -155,34 +626,71 @@ func (k *kBroker) Subscribe(topic string, handler broker.Handler, opts ...broker
 		o(&opt)
 	}
 
-	c, err := sc.NewConsumerFromClient(k.sc, opt.Queue, []string{topic})
+	var offsets map[int32]int64
+	var initial int64
+	var hasInitial bool
+	var rebalance func(claimed, released map[string][]int32)
+	var deadLetter string
+	retry := &retries{backoff: DefaultRetryBackoff}
+
+	if opt.Context != nil {
+		if t, ok := opt.Context.Value(offsetTimeKey{}).(time.Time); ok {
+			o, err := k.timeOffsets(topic, t)
+			if err != nil {
+				return nil, err
+			}
+			offsets = o
+		}
+		if o, ok := opt.Context.Value(partitionOffsetsKey{}).(map[int32]int64); ok {
+			offsets = o
+		}
+		initial, hasInitial = opt.Context.Value(initialOffsetKey{}).(int64)
+		rebalance, _ = opt.Context.Value(rebalanceKey{}).(func(claimed, released map[string][]int32))
+		deadLetter, _ = opt.Context.Value(deadLetterKey{}).(string)
+		if r, ok := opt.Context.Value(retriesKey{}).(*retries); ok {
+			retry = r
+		}
+	}
+
+	if len(offsets) > 0 {
+		if err := k.seek(opt.Queue, topic, offsets); err != nil {
+			return nil, err
+		}
+	}
+
+	var c *sc.Consumer
+	var err error
+
+	if hasInitial || rebalance != nil {
+		// the initial offset and notifications are part of
+		// the client config so the consumer needs a client of its own
+		config := k.getClusterConfig()
+		if hasInitial {
+			config.Config.Consumer.Offsets.Initial = initial
+		}
+		config.Group.Return.Notifications = rebalance != nil
+		c, err = sc.NewConsumer(k.addrs, opt.Queue, []string{topic}, config)
+	} else {
+		c, err = sc.NewConsumerFromClient(k.sc, opt.Queue, []string{topic})
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-		for {
-			select {
-			case err := <-c.Errors():
-				log.Println("consumer error:", err)
-			case sm := <-c.Messages():
-				var m *broker.Message
-				if err := json.Unmarshal(sm.Value, &m); err != nil {
-					continue
-				}
-				if err := handler(&publication{
-					m:  m,
-					t:  sm.Topic,
-					c:  c,
-					km: sm,
-				}); err == nil && opt.AutoAck {
-					c.MarkOffset(sm, "")
-				}
-			}
-		}
-	}()
+	s := &subscriber{
+		s:          c,
+		t:          topic,
+		opts:       opt,
+		retries:    retry.n,
+		backoff:    retry.backoff,
+		deadLetter: deadLetter,
+		exit:       make(chan bool),
+		done:       make(chan bool),
+	}
+
+	go s.run(k, handler, rebalance)
 
-	return &subscriber{s: c, opts: opt}, nil
+	return s, nil
 }
 
 func (k *kBroker) String() string {
@@ -208,5 +716,6 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 
 	return &kBroker{
 		addrs: cAddrs,
+		opts:  options,
 	}
 }
@@ -0,0 +1,307 @@
+package kafka
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/micro/go-micro/broker"
+)
+
+// consumerMessage turns the producer message into the message a consumer reads
+func consumerMessage(t *testing.T, pm *sarama.ProducerMessage) *sarama.ConsumerMessage {
+	v, err := pm.Value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &sarama.ConsumerMessage{
+		Topic: pm.Topic,
+		Value: v,
+	}
+	for _, h := range pm.Headers {
+		h := h
+		sm.Headers = append(sm.Headers, &h)
+	}
+	return sm
+}
+
+func TestEncodeDecode(t *testing.T) {
+	testcases := []struct {
+		name string
+		opts []broker.Option
+	}{
+		{"json", nil},
+		{"native", []broker.Option{NativeMessages()}},
+	}
+
+	msg := &broker.Message{
+		Header: map[string]string{"Content-Type": "application/json", "Id": "1"},
+		Body:   []byte(`{"hello":"world"}`),
+	}
+
+	for _, test := range testcases {
+		k := NewBroker(test.opts...).(*kBroker)
+
+		pm, err := k.encode("test", msg, broker.PublishOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if pm.Topic != "test" {
+			t.Errorf("%s: expected topic test, got %s", test.name, pm.Topic)
+		}
+		if pm.Key != nil {
+			t.Errorf("%s: expected no key, got %v", test.name, pm.Key)
+		}
+
+		m, err := k.decode(consumerMessage(t, pm))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(m, msg) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, msg, m)
+		}
+	}
+}
+
+func TestEncodeNative(t *testing.T) {
+	k := NewBroker(NativeMessages()).(*kBroker)
+
+	pm, err := k.encode("test", &broker.Message{
+		Header: map[string]string{"Id": "1"},
+		Body:   []byte(`hello`),
+	}, broker.PublishOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := pm.Value.Encode()
+	if string(v) != "hello" {
+		t.Errorf("expected raw body hello, got %s", string(v))
+	}
+	if len(pm.Headers) != 1 || string(pm.Headers[0].Key) != "Id" || string(pm.Headers[0].Value) != "1" {
+		t.Errorf("expected record header Id: 1, got %v", pm.Headers)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	k := NewBroker().(*kBroker)
+
+	if _, err := k.decode(&sarama.ConsumerMessage{Value: []byte(`hello`)}); err == nil {
+		t.Fatal("expected error decoding a message which isn't json")
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	msg := &broker.Message{
+		Header: map[string]string{"User": "bob"},
+	}
+
+	testcases := []struct {
+		name string
+		opts []broker.PublishOption
+		key  string
+	}{
+		{"none", nil, ""},
+		{"key", []broker.PublishOption{PartitionKey("alice")}, "alice"},
+		{"header", []broker.PublishOption{PartitionKeyHeader("User")}, "bob"},
+		{"missing header", []broker.PublishOption{PartitionKeyHeader("Other")}, ""},
+		{"key over header", []broker.PublishOption{PartitionKeyHeader("User"), PartitionKey("alice")}, "alice"},
+	}
+
+	for _, test := range testcases {
+		var options broker.PublishOptions
+		for _, o := range test.opts {
+			o(&options)
+		}
+		if key := partitionKey(msg, options); key != test.key {
+			t.Errorf("%s: expected key %q, got %q", test.name, test.key, key)
+		}
+	}
+}
+
+func TestHandleRetries(t *testing.T) {
+	testcases := []struct {
+		name    string
+		retries int
+		// number of calls failing
+		failures int
+		calls    int
+		n        int
+		err      bool
+	}{
+		{"success", 2, 0, 1, 0, false},
+		{"no retries", 0, 1, 1, 0, true},
+		{"retried", 2, 1, 2, 1, false},
+		{"exhausted", 2, 5, 3, 2, true},
+	}
+
+	for _, test := range testcases {
+		s := &subscriber{
+			retries: test.retries,
+			backoff: time.Millisecond,
+			exit:    make(chan bool),
+		}
+
+		var calls int
+		n, err := s.handle(func(p broker.Publication) error {
+			calls++
+			if calls <= test.failures {
+				return errors.New("failed")
+			}
+			return nil
+		}, &publication{})
+
+		if calls != test.calls {
+			t.Errorf("%s: expected %d calls, got %d", test.name, test.calls, calls)
+		}
+		if n != test.n {
+			t.Errorf("%s: expected %d retries, got %d", test.name, test.n, n)
+		}
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestSetSecurity(t *testing.T) {
+	testcases := []struct {
+		name      string
+		opts      []broker.Option
+		tls       bool
+		mechanism sarama.SASLMechanism
+		scram     bool
+	}{
+		{"none", nil, false, "", false},
+		{"secure", []broker.Option{broker.Secure(true)}, true, "", false},
+		{"plain", []broker.Option{SASLPlain("user", "pass")}, false, sarama.SASLTypePlaintext, false},
+		{"scram sha256", []broker.Option{SASLScramSHA256("user", "pass")}, false, sarama.SASLTypeSCRAMSHA256, true},
+		{"scram sha512", []broker.Option{broker.Secure(true), SASLScramSHA512("user", "pass")}, true, sarama.SASLTypeSCRAMSHA512, true},
+	}
+
+	for _, test := range testcases {
+		k := NewBroker(test.opts...).(*kBroker)
+
+		config := sarama.NewConfig()
+		k.setSecurity(config)
+
+		if config.Net.TLS.Enable != test.tls {
+			t.Errorf("%s: expected tls %v, got %v", test.name, test.tls, config.Net.TLS.Enable)
+		}
+
+		sasl := len(test.mechanism) > 0
+		if config.Net.SASL.Enable != sasl {
+			t.Errorf("%s: expected sasl %v, got %v", test.name, sasl, config.Net.SASL.Enable)
+		}
+		if !sasl {
+			continue
+		}
+
+		if config.Net.SASL.Mechanism != test.mechanism {
+			t.Errorf("%s: expected mechanism %s, got %s", test.name, test.mechanism, config.Net.SASL.Mechanism)
+		}
+		if config.Net.SASL.User != "user" || config.Net.SASL.Password != "pass" {
+			t.Errorf("%s: expected credentials user/pass, got %s/%s", test.name, config.Net.SASL.User, config.Net.SASL.Password)
+		}
+		if (config.Net.SASL.SCRAMClientGeneratorFunc != nil) != test.scram {
+			t.Errorf("%s: expected scram client %v", test.name, test.scram)
+		}
+		if !config.Version.IsAtLeast(sarama.V0_10_0_0) {
+			t.Errorf("%s: expected version 0.10 or later, got %s", test.name, config.Version)
+		}
+	}
+}
+
+func TestUnsubscribeFromHandler(t *testing.T) {
+	s := &subscriber{
+		exit: make(chan bool),
+		done: make(chan bool),
+	}
+
+	// the consumer goroutine is in the handler, done isn't closed
+	// until it returned so waiting for it would deadlock
+	s.handling = 1
+
+	if err := s.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-s.exit:
+	default:
+		t.Fatal("expected the consumer loop to be told to exit")
+	}
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	testcases := []struct {
+		name    string
+		header  map[string]string
+		retries int
+		expect  map[string]string
+	}{
+		{
+			"no header",
+			nil,
+			0,
+			map[string]string{
+				ErrorHeader:     "failed",
+				TopicHeader:     "test",
+				PartitionHeader: "3",
+				OffsetHeader:    "42",
+				RetriesHeader:   "0",
+			},
+		},
+		{
+			"header kept",
+			map[string]string{"Id": "1"},
+			2,
+			map[string]string{
+				"Id":            "1",
+				ErrorHeader:     "failed",
+				TopicHeader:     "test",
+				PartitionHeader: "3",
+				OffsetHeader:    "42",
+				RetriesHeader:   "2",
+			},
+		},
+		{
+			"header overwritten",
+			map[string]string{ErrorHeader: "earlier", RetriesHeader: "5"},
+			1,
+			map[string]string{
+				ErrorHeader:     "failed",
+				TopicHeader:     "test",
+				PartitionHeader: "3",
+				OffsetHeader:    "42",
+				RetriesHeader:   "1",
+			},
+		},
+	}
+
+	sm := &sarama.ConsumerMessage{
+		Topic:     "test",
+		Partition: 3,
+		Offset:    42,
+	}
+
+	for _, test := range testcases {
+		m := &broker.Message{
+			Header: test.header,
+			Body:   []byte("hello"),
+		}
+
+		dm := deadLetterMessage(sm, m, test.retries, errors.New("failed"))
+
+		if !reflect.DeepEqual(dm.Header, test.expect) {
+			t.Errorf("%s: expected header %v, got %v", test.name, test.expect, dm.Header)
+		}
+		if string(dm.Body) != "hello" {
+			t.Errorf("%s: expected body hello, got %s", test.name, string(dm.Body))
+		}
+		if len(test.header) != len(m.Header) {
+			t.Errorf("%s: expected the failed message to be left untouched", test.name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package kafka
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/micro/go-micro/broker"
+	"golang.org/x/net/context"
+)
+
+var (
+	// DefaultInitialOffset is used by consumer groups which have no
+	// committed offset yet
+	DefaultInitialOffset = sarama.OffsetNewest
+
+	// DefaultRetryBackoff is the delay before the first retry
+	// of a failed handler, it doubles with every retry
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Headers added to messages sent to the dead letter topic
+const (
+	ErrorHeader     = "x-kafka-error"
+	TopicHeader     = "x-kafka-topic"
+	PartitionHeader = "x-kafka-partition"
+	OffsetHeader    = "x-kafka-offset"
+	RetriesHeader   = "x-kafka-retries"
+)
+
+type saslKey struct{}
+
+type nativeMessagesKey struct{}
+
+type partitionKeyKey struct{}
+
+type partitionKeyHeaderKey struct{}
+
+type asyncProducerKey struct{}
+
+type batchSizeKey struct{}
+
+type lingerKey struct{}
+
+type compressionKey struct{}
+
+type requiredAcksKey struct{}
+
+type initialOffsetKey struct{}
+
+type partitionOffsetsKey struct{}
+
+type offsetTimeKey struct{}
+
+type rebalanceKey struct{}
+
+type retriesKey struct{}
+
+type deadLetterKey struct{}
+
+type saslAuth struct {
+	mechanism sarama.SASLMechanism
+	user      string
+	password  string
+}
+
+func setSASL(mechanism sarama.SASLMechanism, user, password string) broker.Option {
+	return setBrokerOption(saslKey{}, &saslAuth{
+		mechanism: mechanism,
+		user:      user,
+		password:  password,
+	})
+}
+
+// SASLPlain authenticates with the brokers using SASL/PLAIN. It should be
+// combined with broker.Secure or broker.TLSConfig as the password is sent
+// in the clear.
+func SASLPlain(user, password string) broker.Option {
+	return setSASL(sarama.SASLTypePlaintext, user, password)
+}
+
+// SASLScramSHA256 authenticates with the brokers using SASL/SCRAM-SHA-256
+func SASLScramSHA256(user, password string) broker.Option {
+	return setSASL(sarama.SASLTypeSCRAMSHA256, user, password)
+}
+
+// SASLScramSHA512 authenticates with the brokers using SASL/SCRAM-SHA-512
+func SASLScramSHA512(user, password string) broker.Option {
+	return setSASL(sarama.SASLTypeSCRAMSHA512, user, password)
+}
+
+// NativeMessages publishes the message body as the raw record value and the
+// message header as record headers instead of a JSON encoded broker.Message.
+// Record headers require Kafka 0.11 or later.
+func NativeMessages() broker.Option {
+	return setBrokerOption(nativeMessagesKey{}, true)
+}
+
+type asyncProducer struct {
+	errors    chan<- *sarama.ProducerError
+	successes chan<- *sarama.ProducerMessage
+}
+
+func setBrokerOption(k, v interface{}) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+// AsyncProducer publishes through a batching sarama.AsyncProducer. Publish
+// returns once the message is queued. Delivery failures are sent to errors
+// and, if not nil, acknowledged messages to successes. Both channels must be
+// drained by the caller. Failures are logged when errors is nil. Disconnect
+// flushes all in-flight messages.
+func AsyncProducer(errors chan<- *sarama.ProducerError, successes chan<- *sarama.ProducerMessage) broker.Option {
+	return setBrokerOption(asyncProducerKey{}, &asyncProducer{
+		errors:    errors,
+		successes: successes,
+	})
+}
+
+// ProducerBatchSize sets the number of messages which triggers a flush
+func ProducerBatchSize(n int) broker.Option {
+	return setBrokerOption(batchSizeKey{}, n)
+}
+
+// ProducerLinger sets the maximum time messages are buffered before a flush
+func ProducerLinger(d time.Duration) broker.Option {
+	return setBrokerOption(lingerKey{}, d)
+}
+
+// ProducerCompression sets the compression codec of produced batches
+func ProducerCompression(codec sarama.CompressionCodec) broker.Option {
+	return setBrokerOption(compressionKey{}, codec)
+}
+
+// ProducerRequiredAcks sets the acks required from the brokers
+// before a message is considered delivered
+func ProducerRequiredAcks(acks sarama.RequiredAcks) broker.Option {
+	return setBrokerOption(requiredAcksKey{}, acks)
+}
+
+// PartitionKey sets the record key used to pick the partition. Messages
+// with the same key land on the same partition and keep their order.
+func PartitionKey(key string) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, partitionKeyKey{}, key)
+	}
+}
+
+// PartitionKeyHeader derives the record key from the value of the
+// given message header.
+func PartitionKeyHeader(name string) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, partitionKeyHeaderKey{}, name)
+	}
+}
+
+// InitialOffset sets the offset a new consumer group starts from when it
+// has no committed offset. Use sarama.OffsetOldest to backfill a topic.
+func InitialOffset(offset int64) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, initialOffsetKey{}, offset)
+	}
+}
+
+// PartitionOffsets resets the committed offsets of the consumer group to the
+// given offset per partition before the subscription starts consuming.
+func PartitionOffsets(offsets map[int32]int64) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, partitionOffsetsKey{}, offsets)
+	}
+}
+
+// OffsetTime resets the committed offsets of the consumer group on every
+// partition to the first message produced at or after t. Kafka only resolves
+// timestamps precisely from version 0.10.1 onwards, older brokers seek to
+// the start of the matching log segment.
+func OffsetTime(t time.Time) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, offsetTimeKey{}, t)
+	}
+}
+
+// Rebalance registers a callback which is run once a rebalance of the
+// consumer group completed, with the partitions per topic the subscriber
+// claimed and released. The partitions have moved by then, so it can't act
+// before they are released, and messages of released partitions which were
+// fetched already may still be handled after it. The callback runs on the
+// same goroutine as the handler so no message is being handled while it runs.
+func Rebalance(fn func(claimed, released map[string][]int32)) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, rebalanceKey{}, fn)
+	}
+}
+
+type retries struct {
+	n       int
+	backoff time.Duration
+}
+
+// Retries runs a failed handler up to n more times. The delay between
+// attempts starts at backoff and doubles with every retry.
+func Retries(n int, backoff time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, retriesKey{}, &retries{
+			n:       n,
+			backoff: backoff,
+		})
+	}
+}
+
+// DeadLetterTopic publishes messages the handler failed on, after all
+// retries, to topic and commits their offset. The original headers are
+// kept and the error, topic, partition, offset and number of retries are
+// added to them. Dead letters are sent synchronously, with a producer of
+// their own when AsyncProducer is set.
+func DeadLetterTopic(topic string) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, deadLetterKey{}, topic)
+	}
+}
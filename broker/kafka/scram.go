@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/xdg/scram"
+)
+
+var (
+	sha256Fn scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
+	sha512Fn scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// scramClient implements sarama.SCRAMClient
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (s *scramClient) Begin(user, password, authzID string) error {
+	c, err := s.HashGeneratorFcn.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.Client = c
+	s.ClientConversation = c.NewConversation()
+	return nil
+}
+
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.ClientConversation.Step(challenge)
+}
+
+func (s *scramClient) Done() bool {
+	return s.ClientConversation.Done()
+}
@@ -0,0 +1,19 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker()
+	},
+		// delivery is synchronous
+		conformance.Settle(10*time.Millisecond),
+		conformance.Redeliver(Redeliver),
+	)
+}
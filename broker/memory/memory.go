@@ -0,0 +1,329 @@
+package memory
+
+/*
+	Memory is an in-process go-micro Broker for unit tests and
+	single process services. No server is required.
+
+	Publish delivers the message synchronously to the handlers
+	of the matching subscribers before it returns. Subscribers
+	sharing a Queue compete for messages, each message being
+	delivered to one of them in turn.
+
+	Topics are segmented on dots. A subscriber topic may contain
+	wildcards: * matches a single segment and > matches one or
+	more trailing segments, e.g. go.micro.* or go.micro.>.
+
+	Messages are acked once the handler returns without error if
+	AutoAck is set, otherwise when the handler calls Ack. Unacked
+	messages stay pending until they are redelivered with Redeliver.
+	See testing.go for the helpers to assert on published messages.
+*/
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-micro/cmd"
+)
+
+type memoryBroker struct {
+	opts broker.Options
+
+	sync.RWMutex
+	connected bool
+	// subscribers in the order they subscribed
+	subs []*memorySubscriber
+	// published messages by topic
+	published map[string][]*broker.Message
+	// next queue member to deliver to by queue name
+	next map[string]int
+}
+
+type memorySubscriber struct {
+	b       *memoryBroker
+	topic   string
+	handler broker.Handler
+	opts    broker.SubscribeOptions
+
+	sync.Mutex
+	// delivered but unacked publications
+	pending []*memoryPublication
+}
+
+type memoryPublication struct {
+	s     *memorySubscriber
+	topic string
+	m     *broker.Message
+
+	sync.Mutex
+	acked bool
+}
+
+func init() {
+	cmd.DefaultBrokers["memory"] = NewBroker
+}
+
+func (p *memoryPublication) Topic() string {
+	return p.topic
+}
+
+func (p *memoryPublication) Message() *broker.Message {
+	return p.m
+}
+
+// Ack removes the publication from the pending messages of the subscriber.
+func (p *memoryPublication) Ack() error {
+	p.Lock()
+	p.acked = true
+	p.Unlock()
+
+	p.s.Lock()
+	defer p.s.Unlock()
+	for i, pp := range p.s.pending {
+		if pp == p {
+			p.s.pending = append(p.s.pending[:i], p.s.pending[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (p *memoryPublication) isAcked() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.acked
+}
+
+func (s *memorySubscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *memorySubscriber) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe removes the subscriber, its pending messages are dropped.
+func (s *memorySubscriber) Unsubscribe() error {
+	s.b.Lock()
+	defer s.b.Unlock()
+	for i, ss := range s.b.subs {
+		if ss == s {
+			s.b.subs = append(s.b.subs[:i], s.b.subs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// deliver calls the handler with the publication and acks it if AutoAck
+// is set and the handler succeeded. Otherwise it stays pending until
+// acked by the handler.
+func (s *memorySubscriber) deliver(p *memoryPublication) error {
+	s.Lock()
+	s.pending = append(s.pending, p)
+	s.Unlock()
+
+	if err := s.handler(p); err != nil {
+		return err
+	}
+
+	if s.opts.AutoAck && !p.isAcked() {
+		return p.Ack()
+	}
+	return nil
+}
+
+// match reports whether the topic matches the subscriber topic
+// pattern, which may contain the wildcards * and >
+func match(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+
+	pp := strings.Split(pattern, ".")
+	tp := strings.Split(topic, ".")
+
+	for i, p := range pp {
+		switch {
+		case p == ">":
+			// matches one or more remaining segments
+			return i == len(pp)-1 && len(tp) > i
+		case i >= len(tp):
+			return false
+		case p == "*":
+			continue
+		case p != tp[i]:
+			return false
+		}
+	}
+
+	return len(pp) == len(tp)
+}
+
+// copyMessage copies the message so handlers
+// don't modify what others received
+func copyMessage(m *broker.Message) *broker.Message {
+	header := make(map[string]string, len(m.Header))
+	for k, v := range m.Header {
+		header[k] = v
+	}
+	body := make([]byte, len(m.Body))
+	copy(body, m.Body)
+	return &broker.Message{
+		Header: header,
+		Body:   body,
+	}
+}
+
+// subscribers returns the subscribers the message published on the topic
+// is delivered to: all subscribers without a queue and one subscriber per
+// queue, chosen in turn.
+func (m *memoryBroker) subscribers(topic string) []*memorySubscriber {
+	m.Lock()
+	defer m.Unlock()
+
+	var subs []*memorySubscriber
+	queues := make(map[string][]*memorySubscriber)
+	var names []string
+
+	for _, s := range m.subs {
+		if !match(s.topic, topic) {
+			continue
+		}
+		if len(s.opts.Queue) == 0 {
+			subs = append(subs, s)
+			continue
+		}
+		if _, ok := queues[s.opts.Queue]; !ok {
+			names = append(names, s.opts.Queue)
+		}
+		queues[s.opts.Queue] = append(queues[s.opts.Queue], s)
+	}
+
+	for _, name := range names {
+		members := queues[name]
+		i := m.next[name] % len(members)
+		m.next[name] = i + 1
+		subs = append(subs, members[i])
+	}
+
+	return subs
+}
+
+// deliver delivers the message to the matching subscribers
+// and returns the first error returned by a handler
+func (m *memoryBroker) deliver(topic string, msg *broker.Message) error {
+	var err error
+	for _, s := range m.subscribers(topic) {
+		p := &memoryPublication{
+			s:     s,
+			topic: topic,
+			m:     copyMessage(msg),
+		}
+		if herr := s.deliver(p); herr != nil && err == nil {
+			err = herr
+		}
+	}
+	return err
+}
+
+func (m *memoryBroker) Options() broker.Options {
+	return m.opts
+}
+
+func (m *memoryBroker) Address() string {
+	return "memory"
+}
+
+func (m *memoryBroker) Connect() error {
+	m.Lock()
+	m.connected = true
+	m.Unlock()
+	return nil
+}
+
+// Disconnect stops delivering messages, subscribers
+// are kept and receive messages once reconnected
+func (m *memoryBroker) Disconnect() error {
+	m.Lock()
+	m.connected = false
+	m.Unlock()
+	return nil
+}
+
+func (m *memoryBroker) Init(opts ...broker.Option) error {
+	for _, o := range opts {
+		o(&m.opts)
+	}
+	return nil
+}
+
+func (m *memoryBroker) isConnected() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.connected
+}
+
+// Publish records the message and delivers it to the matching subscribers.
+// Handler errors are logged, the message stays pending with the subscriber.
+func (m *memoryBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	if !m.isConnected() {
+		return errors.New("not connected")
+	}
+
+	m.Lock()
+	m.published[topic] = append(m.published[topic], copyMessage(msg))
+	m.Unlock()
+
+	if err := m.deliver(topic, msg); err != nil {
+		log.Printf("memory: handler error on topic %s: %v", topic, err)
+	}
+	return nil
+}
+
+func (m *memoryBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if !m.isConnected() {
+		return nil, errors.New("not connected")
+	}
+
+	options := broker.SubscribeOptions{
+		AutoAck: true,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	s := &memorySubscriber{
+		b:       m,
+		topic:   topic,
+		handler: handler,
+		opts:    options,
+	}
+
+	m.Lock()
+	m.subs = append(m.subs, s)
+	m.Unlock()
+
+	return s, nil
+}
+
+func (m *memoryBroker) String() string {
+	return "memory"
+}
+
+func NewBroker(opts ...broker.Option) broker.Broker {
+	var options broker.Options
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return &memoryBroker{
+		opts:      options,
+		published: make(map[string][]*broker.Message),
+		next:      make(map[string]int),
+	}
+}
@@ -0,0 +1,181 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/micro/go-micro/broker"
+)
+
+func TestMatch(t *testing.T) {
+	testData := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+		{"foo.>.baz", "foo.bar.baz", false},
+	}
+
+	for _, d := range testData {
+		if m := match(d.pattern, d.topic); m != d.match {
+			t.Fatalf("Expected match(%s, %s) to be %v got %v", d.pattern, d.topic, d.match, m)
+		}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := NewBroker()
+
+	if err := b.Publish("foo", &broker.Message{}); err == nil {
+		t.Fatal("Expected error publishing while not connected")
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	sub, err := b.Subscribe("foo.*", func(p broker.Publication) error {
+		got = append(got, p.Message().Header["id"])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		msg := &broker.Message{Header: map[string]string{"id": id}}
+		if err := b.Publish("foo.bar", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("Expected messages 1 and 2 got %v", got)
+	}
+
+	if p := Published(b, "foo.bar"); len(p) != 2 {
+		t.Fatalf("Expected 2 published messages got %d", len(p))
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("foo.bar", &broker.Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Expected no message after unsubscribe got %d", len(got))
+	}
+
+	Reset(b)
+
+	if p := Published(b, "foo.bar"); len(p) != 0 {
+		t.Fatalf("Expected no published messages after reset got %d", len(p))
+	}
+}
+
+func TestQueue(t *testing.T) {
+	b := NewBroker()
+	b.Connect()
+
+	counts := make([]int, 3)
+	for i := range counts {
+		i := i
+		_, err := b.Subscribe("foo", func(p broker.Publication) error {
+			counts[i]++
+			return nil
+		}, broker.Queue("queue"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := b.Publish("foo", &broker.Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, c := range counts {
+		if c != 2 {
+			t.Fatalf("Expected queue member %d to receive 2 messages got %d", i, c)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	b := NewBroker()
+	b.Connect()
+
+	var ack bool
+	_, err := b.Subscribe("foo", func(p broker.Publication) error {
+		if ack {
+			return p.Ack()
+		}
+		return nil
+	}, broker.DisableAutoAck())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.Subscribe("foo", func(p broker.Publication) error {
+		return errors.New("error")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Deliver(b, "foo", &broker.Message{}); err == nil {
+		t.Fatal("Expected handler error")
+	}
+
+	// unacked and failed
+	if p := Pending(b, "foo"); len(p) != 2 {
+		t.Fatalf("Expected 2 pending messages got %d", len(p))
+	}
+
+	ack = true
+
+	if err := Redeliver(b); err == nil {
+		t.Fatal("Expected handler error")
+	}
+
+	if p := Pending(b, "foo"); len(p) != 1 {
+		t.Fatalf("Expected 1 pending message got %d", len(p))
+	}
+}
+
+func TestPendingWildcard(t *testing.T) {
+	b := NewBroker()
+	b.Connect()
+
+	_, err := b.Subscribe("orders.*", func(p broker.Publication) error {
+		return nil
+	}, broker.DisableAutoAck())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Deliver(b, "orders.created", &broker.Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := Pending(b, "orders.created"); len(p) != 1 {
+		t.Fatalf("Expected 1 pending message got %d", len(p))
+	}
+
+	if p := Pending(b, "orders.deleted"); len(p) != 0 {
+		t.Fatalf("Expected no pending message got %d", len(p))
+	}
+}
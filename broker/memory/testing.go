@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"errors"
+
+	"github.com/micro/go-micro/broker"
+)
+
+// ErrNotSupported is returned for brokers which are not a memory broker
+var ErrNotSupported = errors.New("memory: not a memory broker")
+
+// Published returns copies of the messages published on the topic
+// in the order they were published.
+func Published(b broker.Broker, topic string) []*broker.Message {
+	m, ok := b.(*memoryBroker)
+	if !ok {
+		return nil
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	msgs := make([]*broker.Message, 0, len(m.published[topic]))
+	for _, msg := range m.published[topic] {
+		msgs = append(msgs, copyMessage(msg))
+	}
+	return msgs
+}
+
+// Reset forgets the messages published so far.
+func Reset(b broker.Broker) {
+	m, ok := b.(*memoryBroker)
+	if !ok {
+		return
+	}
+
+	m.Lock()
+	m.published = make(map[string][]*broker.Message)
+	m.Unlock()
+}
+
+// Deliver delivers the message to the subscribers of the topic like
+// Publish, but returns the first error returned by a handler. The message
+// is not recorded as published. Use it to drive handlers in tests.
+func Deliver(b broker.Broker, topic string, msg *broker.Message) error {
+	m, ok := b.(*memoryBroker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return m.deliver(topic, msg)
+}
+
+// Pending returns the messages published on the topic which were
+// delivered to subscribers, including wildcard subscribers, and were
+// not acked yet.
+func Pending(b broker.Broker, topic string) []*broker.Message {
+	m, ok := b.(*memoryBroker)
+	if !ok {
+		return nil
+	}
+
+	m.RLock()
+	subs := append([]*memorySubscriber(nil), m.subs...)
+	m.RUnlock()
+
+	var msgs []*broker.Message
+	for _, s := range subs {
+		s.Lock()
+		for _, p := range s.pending {
+			if p.topic != topic {
+				continue
+			}
+			msgs = append(msgs, copyMessage(p.m))
+		}
+		s.Unlock()
+	}
+	return msgs
+}
+
+// Redeliver delivers the pending messages to their subscribers again
+// and returns the first error returned by a handler. Messages which are
+// not acked once more stay pending.
+func Redeliver(b broker.Broker) error {
+	m, ok := b.(*memoryBroker)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	m.RLock()
+	subs := append([]*memorySubscriber(nil), m.subs...)
+	m.RUnlock()
+
+	var err error
+	for _, s := range subs {
+		s.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.Unlock()
+
+		for _, p := range pending {
+			pp := &memoryPublication{
+				s:     s,
+				topic: p.topic,
+				m:     p.m,
+			}
+			if herr := s.deliver(pp); herr != nil && err == nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("MQTT_ADDR")
+	if addr == "" {
+		t.Skip("MQTT_ADDR not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(broker.Addrs(addr))
+	},
+		conformance.Skip(conformance.CompetingConsumers, "MQTT has no queue groups"),
+		conformance.Skip(conformance.AckRedelivery, "messages are acked on receipt"),
+		conformance.Settle(500*time.Millisecond),
+	)
+}
@@ -5,17 +5,19 @@ package mqtt
 	This can be integrated with any broker that supports MQTT,
 	including Mosquito and AWS IoT.
 
-	TODO: Strip encoding?
 	Where brokers don't support headers we're actually
 	encoding the broker.Message in json to simplify usage
-	and cross broker compatibility. To actually use the
-	MQTT broker more widely on the internet we may need to
-	support stripping the encoding.
-
-	Note: Because of the way the MQTT library works, when you
-	unsubscribe from a topic it will unsubscribe all subscribers.
-	TODO: Perhaps create a unique client per subscription.
-	Becomes slightly more difficult to track a disconnect.
+	and cross broker compatibility. To use the MQTT broker
+	more widely on the internet, e.g. with plain IoT devices,
+	the RawPayload option strips the encoding.
+
+	Because of the way the MQTT library works, unsubscribing
+	from a topic unsubscribes all handlers of the client.
+	Each subscription therefore has a client of its own so
+	Unsubscribe only affects its own handler. These clients
+	use clean sessions, no session is left on the server
+	once they disconnect, and subscribe again whenever they
+	reconnect.
 
 */
 
@@ -27,16 +29,24 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/micro/go-micro/broker"
+	"golang.org/x/net/context"
 )
 
 type mqttBroker struct {
 	addrs  []string
 	opts   broker.Options
 	client mqtt.Client
+
+	sync.Mutex
+	// clients of the subscriptions
+	subs map[*mqttSub]bool
+	// creates the client of a subscription if set
+	subClient func(mqtt.OnConnectHandler) mqtt.Client
 }
 
 func init() {
@@ -115,11 +125,14 @@ func setAddrs(addrs []string) []string {
 	return cAddrs
 }
 
-func newClient(addrs []string, opts broker.Options) mqtt.Client {
+func newClient(addrs []string, opts broker.Options, clean bool, onConnect mqtt.OnConnectHandler) mqtt.Client {
 	// create opts
 	cOpts := mqtt.NewClientOptions()
 	cOpts.SetClientID(fmt.Sprintf("%d%d", time.Now().UnixNano(), rand.Intn(10)))
-	cOpts.SetCleanSession(false)
+	cOpts.SetCleanSession(clean)
+	if onConnect != nil {
+		cOpts.SetOnConnectHandler(onConnect)
+	}
 
 	// setup tls
 	if opts.TLSConfig != nil {
@@ -141,13 +154,55 @@ func newBroker(opts ...broker.Option) broker.Broker {
 	}
 
 	addrs := setAddrs(options.Addrs)
-	client := newClient(addrs, options)
+	client := newClient(addrs, options, false, nil)
 
 	return &mqttBroker{
 		opts:   options,
 		client: client,
 		addrs:  addrs,
+		subs:   make(map[*mqttSub]bool),
+	}
+}
+
+func (m *mqttBroker) rawPayload() bool {
+	if m.opts.Context == nil {
+		return false
+	}
+	raw, _ := m.opts.Context.Value(rawPayloadKey{}).(bool)
+	return raw
+}
+
+// qos returns the quality of service set in ctx
+// under key k or the default if not set
+func qos(ctx context.Context, k interface{}) (byte, error) {
+	if ctx == nil {
+		return DefaultQoS, nil
+	}
+	q, ok := ctx.Value(k).(byte)
+	if !ok {
+		return DefaultQoS, nil
+	}
+	if q > 2 {
+		return 0, fmt.Errorf("invalid qos %d", q)
 	}
+	return q, nil
+}
+
+// newSubClient returns the client of a new subscription. Its random
+// client id is never reused, so it has a clean session. The server
+// forgets the subscription when the connection is lost, onConnect
+// subscribes again once reconnected.
+func (m *mqttBroker) newSubClient(onConnect mqtt.OnConnectHandler) mqtt.Client {
+	if m.subClient != nil {
+		return m.subClient(onConnect)
+	}
+	return newClient(m.addrs, m.opts, true, onConnect)
+}
+
+func (m *mqttBroker) untrack(s *mqttSub) {
+	m.Lock()
+	delete(m.subs, s)
+	m.Unlock()
 }
 
 func (m *mqttBroker) Options() broker.Options {
@@ -171,10 +226,17 @@ func (m *mqttBroker) Connect() error {
 }
 
 func (m *mqttBroker) Disconnect() error {
-	if !m.client.IsConnected() {
-		return nil
+	// the subscriptions have clients of their own
+	m.Lock()
+	for s := range m.subs {
+		s.client.Disconnect(0)
+		delete(m.subs, s)
+	}
+	m.Unlock()
+
+	if m.client.IsConnected() {
+		m.client.Disconnect(0)
 	}
-	m.client.Disconnect(0)
 	return nil
 }
 
@@ -188,7 +250,7 @@ func (m *mqttBroker) Init(opts ...broker.Option) error {
 	}
 
 	m.addrs = setAddrs(m.opts.Addrs)
-	m.client = newClient(m.addrs, m.opts)
+	m.client = newClient(m.addrs, m.opts, false, nil)
 	return nil
 }
 
@@ -197,12 +259,30 @@ func (m *mqttBroker) Publish(topic string, msg *broker.Message, opts ...broker.P
 		return errors.New("not connected")
 	}
 
-	b, err := json.Marshal(msg)
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	q, err := qos(options.Context, publishQoSKey{})
 	if err != nil {
 		return err
 	}
 
-	t := m.client.Publish(topic, 1, false, b)
+	var retained bool
+	if options.Context != nil {
+		retained, _ = options.Context.Value(retainedKey{}).(bool)
+	}
+
+	b := msg.Body
+	if !m.rawPayload() {
+		b, err = json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	t := m.client.Publish(topic, q, retained, b)
 	return t.Error()
 }
 
@@ -216,27 +296,61 @@ func (m *mqttBroker) Subscribe(topic string, h broker.Handler, opts ...broker.Su
 		o(&options)
 	}
 
-	t := m.client.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
+	q, err := qos(options.Context, subscribeQoSKey{})
+	if err != nil {
+		return nil, err
+	}
+
+	raw := m.rawPayload()
+
+	cb := func(c mqtt.Client, mm mqtt.Message) {
 		var msg *broker.Message
-		if err := json.Unmarshal(m.Payload(), &msg); err != nil {
+		if raw {
+			msg = &broker.Message{
+				Header: make(map[string]string),
+				Body:   mm.Payload(),
+			}
+		} else if err := json.Unmarshal(mm.Payload(), &msg); err != nil {
 			log.Println(err)
 			return
 		}
 
-		if err := h(&mqttPub{topic: topic, msg: msg}); err != nil {
+		if err := h(&mqttPub{topic: mm.Topic(), msg: msg}); err != nil {
 			log.Println(err)
 		}
+	}
+
+	// a client of its own so unsubscribing
+	// doesn't affect other subscriptions
+	client := m.newSubClient(func(c mqtt.Client) {
+		// also called on the first connect, subscribing
+		// twice to the same topic replaces the subscription
+		if t := c.Subscribe(topic, q, cb); t.Wait() && t.Error() != nil {
+			log.Println("resubscribe error:", t.Error())
+		}
 	})
+	if t := client.Connect(); t.Wait() && t.Error() != nil {
+		return nil, t.Error()
+	}
 
+	t := client.Subscribe(topic, q, cb)
 	if t.Wait() && t.Error() != nil {
+		client.Disconnect(0)
 		return nil, t.Error()
 	}
 
-	return &mqttSub{
+	s := &mqttSub{
 		opts:   options,
-		client: m.client,
+		client: client,
 		topic:  topic,
-	}, nil
+		b:      m,
+	}
+
+	m.Lock()
+	m.subs[s] = true
+	m.Unlock()
+
+	return s, nil
 }
 
 func (m *mqttBroker) String() string {
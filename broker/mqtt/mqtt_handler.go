@@ -1,10 +1,17 @@
 package mqtt
 
 import (
+	"errors"
+	"time"
+
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/micro/go-micro/broker"
 )
 
+// UnsubscribeTimeout is how long Unsubscribe waits
+// for the server to confirm the unsubscribe
+var UnsubscribeTimeout = 10 * time.Second
+
 // mqttPub is a broker.Publication
 type mqttPub struct {
 	topic string
@@ -16,6 +23,8 @@ type mqttSub struct {
 	opts   broker.SubscribeOptions
 	topic  string
 	client mqtt.Client
+	// broker tracking the subscription
+	b *mqttBroker
 }
 
 func (m *mqttPub) Ack() error {
@@ -38,7 +47,20 @@ func (m *mqttSub) Topic() string {
 	return m.topic
 }
 
+// Unsubscribe unsubscribes the topic and
+// disconnects the client of the subscription
 func (m *mqttSub) Unsubscribe() error {
+	if m.b != nil {
+		m.b.untrack(m)
+	}
+	if !m.client.IsConnected() {
+		return nil
+	}
 	t := m.client.Unsubscribe(m.topic)
+	if !t.WaitTimeout(UnsubscribeTimeout) {
+		m.client.Disconnect(0)
+		return errors.New("timed out waiting for unsubscribe")
+	}
+	m.client.Disconnect(250)
 	return t.Error()
 }
@@ -14,8 +14,21 @@ type mockClient struct {
 	exit      chan bool
 
 	subs map[string][]mqtt.MessageHandler
+
+	// network the client publishes to, if any
+	net *mockNetwork
+}
+
+// mockNetwork delivers the messages published by
+// any of its clients to all of its clients
+type mockNetwork struct {
+	sync.Mutex
+	clients []*mockClient
 }
 
+// mockToken is a token which is complete
+type mockToken struct{}
+
 type mockMessage struct {
 	id       uint16
 	topic    string
@@ -27,6 +40,7 @@ type mockMessage struct {
 var (
 	_ mqtt.Client  = newMockClient()
 	_ mqtt.Message = newMockMessage("mock", 0, false, nil)
+	_ mqtt.Token   = &mockToken{}
 )
 
 func init() {
@@ -39,6 +53,22 @@ func newMockClient() mqtt.Client {
 	}
 }
 
+func newMockNetwork() *mockNetwork {
+	return &mockNetwork{}
+}
+
+// newClient returns a client of the network
+func (n *mockNetwork) newClient() mqtt.Client {
+	c := newMockClient().(*mockClient)
+	c.net = n
+
+	n.Lock()
+	n.clients = append(n.clients, c)
+	n.Unlock()
+
+	return c
+}
+
 func newMockMessage(topic string, qos byte, retained bool, payload interface{}) mqtt.Message {
 	return &mockMessage{
 		id:       uint16(rand.Int()),
@@ -49,6 +79,18 @@ func newMockMessage(topic string, qos byte, retained bool, payload interface{})
 	}
 }
 
+func (t *mockToken) Wait() bool {
+	return true
+}
+
+func (t *mockToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *mockToken) Error() error {
+	return nil
+}
+
 func (m *mockMessage) Duplicate() bool {
 	return false
 }
@@ -89,7 +131,7 @@ func (m *mockClient) Connect() mqtt.Token {
 
 	m.connected = true
 	m.exit = make(chan bool)
-	return &mqtt.ConnectToken{}
+	return &mockToken{}
 }
 
 func (m *mockClient) Disconnect(uint) {
@@ -111,20 +153,39 @@ func (m *mockClient) Disconnect(uint) {
 }
 
 func (m *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
-	m.Lock()
-	defer m.Unlock()
-
-	if !m.connected {
+	if !m.IsConnected() {
 		return nil
 	}
 
 	msg := newMockMessage(topic, qos, retained, payload)
 
-	for _, sub := range m.subs[topic] {
-		sub(m, msg)
+	clients := []*mockClient{m}
+	if m.net != nil {
+		m.net.Lock()
+		clients = append([]*mockClient(nil), m.net.clients...)
+		m.net.Unlock()
+	}
+
+	for _, c := range clients {
+		c.deliver(msg)
 	}
 
-	return &mqtt.PublishToken{}
+	return &mockToken{}
+}
+
+// deliver calls the handlers of the topic of the message
+func (m *mockClient) deliver(msg mqtt.Message) {
+	m.Lock()
+	if !m.connected {
+		m.Unlock()
+		return
+	}
+	handlers := append([]mqtt.MessageHandler(nil), m.subs[msg.Topic()]...)
+	m.Unlock()
+
+	for _, h := range handlers {
+		h(m, msg)
+	}
 }
 
 func (m *mockClient) Subscribe(topic string, qos byte, h mqtt.MessageHandler) mqtt.Token {
@@ -137,7 +198,7 @@ func (m *mockClient) Subscribe(topic string, qos byte, h mqtt.MessageHandler) mq
 
 	m.subs[topic] = append(m.subs[topic], h)
 
-	return &mqtt.SubscribeToken{}
+	return &mockToken{}
 }
 
 func (m *mockClient) SubscribeMultiple(topics map[string]byte, h mqtt.MessageHandler) mqtt.Token {
@@ -152,7 +213,7 @@ func (m *mockClient) SubscribeMultiple(topics map[string]byte, h mqtt.MessageHan
 		m.subs[topic] = append(m.subs[topic], h)
 	}
 
-	return &mqtt.SubscribeToken{}
+	return &mockToken{}
 }
 
 func (m *mockClient) Unsubscribe(topics ...string) mqtt.Token {
@@ -167,5 +228,5 @@ func (m *mockClient) Unsubscribe(topics ...string) mqtt.Token {
 		delete(m.subs, topic)
 	}
 
-	return &mqtt.UnsubscribeToken{}
+	return &mockToken{}
 }
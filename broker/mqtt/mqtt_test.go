@@ -87,3 +87,152 @@ func TestMQTT(t *testing.T) {
 
 	b.(*mqttBroker).client.Disconnect(0)
 }
+
+func TestMQTTUnsubscribeIsolation(t *testing.T) {
+	b := NewBroker()
+
+	// use mock clients of the same network
+	net := newMockNetwork()
+	b.(*mqttBroker).client = net.newClient()
+	b.(*mqttBroker).subClient = func(mqtt.OnConnectHandler) mqtt.Client {
+		return net.newClient()
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got1, got2 []string
+
+	s1, err := b.Subscribe("mock", func(p broker.Publication) error {
+		got1 = append(got1, string(p.Message().Body))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := b.Subscribe("mock", func(p broker.Publication) error {
+		got2 = append(got2, string(p.Message().Body))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("mock", &broker.Message{Body: []byte(`hello`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s1.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("mock", &broker.Message{Body: []byte(`world`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got1) != 1 || got1[0] != "hello" {
+		t.Fatalf("Expected [hello] for the unsubscribed subscription got %v", got1)
+	}
+
+	if len(got2) != 2 || got2[0] != "hello" || got2[1] != "world" {
+		t.Fatalf("Expected [hello world] for the other subscription got %v", got2)
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s2.(*mqttSub).client.IsConnected() {
+		t.Fatal("Expected the client of the subscription to be disconnected")
+	}
+}
+
+func TestMQTTResubscribe(t *testing.T) {
+	b := NewBroker()
+
+	net := newMockNetwork()
+	b.(*mqttBroker).client = net.newClient()
+
+	var client mqtt.Client
+	var onConnect mqtt.OnConnectHandler
+	b.(*mqttBroker).subClient = func(h mqtt.OnConnectHandler) mqtt.Client {
+		client = net.newClient()
+		onConnect = h
+		return client
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	var got []string
+	if _, err := b.Subscribe("mock", func(p broker.Publication) error {
+		got = append(got, string(p.Message().Body))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// reconnect with a clean session, the server forgot the subscription
+	c := client.(*mockClient)
+	c.Lock()
+	c.subs = make(map[string][]mqtt.MessageHandler)
+	c.Unlock()
+	onConnect(client)
+
+	if err := b.Publish("mock", &broker.Message{Body: []byte(`hello`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0] != "hello" {
+		t.Fatalf("Expected [hello] after reconnecting got %v", got)
+	}
+}
+
+func TestMQTTPublishOptions(t *testing.T) {
+	b := NewBroker(RawPayload())
+
+	// use mock client
+	c := newMockClient()
+	b.(*mqttBroker).client = c
+
+	if tk := c.Connect(); tk == nil {
+		t.Fatal("got nil token")
+	}
+
+	var got mqtt.Message
+	if tk := c.Subscribe("mock", 2, func(cm mqtt.Client, m mqtt.Message) {
+		got = m
+	}); tk == nil {
+		t.Fatal("got nil token")
+	}
+
+	if err := b.Publish("mock", &broker.Message{Body: []byte(`hello`)}, PublishQoS(2), Retained()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got == nil {
+		t.Fatal("Expected message to be published")
+	}
+
+	if got.Qos() != 2 {
+		t.Fatalf("Expected qos 2 got %d", got.Qos())
+	}
+
+	if !got.Retained() {
+		t.Fatal("Expected message to be retained")
+	}
+
+	if string(got.Payload()) != "hello" {
+		t.Fatalf("Expected raw payload `hello` got %s", string(got.Payload()))
+	}
+
+	if err := b.Publish("mock", &broker.Message{Body: []byte(`hello`)}, PublishQoS(3)); err == nil {
+		t.Fatal("Expected error publishing with qos 3")
+	}
+
+	c.Disconnect(0)
+}
@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"github.com/micro/go-micro/broker"
+	"golang.org/x/net/context"
+)
+
+// DefaultQoS is the quality of service messages are
+// published and subscribed with unless set otherwise
+var DefaultQoS byte = 1
+
+type rawPayloadKey struct{}
+
+type subscribeQoSKey struct{}
+
+type publishQoSKey struct{}
+
+type retainedKey struct{}
+
+// RawPayload publishes the message body as the MQTT payload and delivers
+// received payloads as the message body, skipping the JSON encoding of
+// the broker.Message. Headers are not supported in this mode. Use it to
+// talk to devices and services which aren't go-micro based.
+func RawPayload() broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, rawPayloadKey{}, true)
+	}
+}
+
+// SubscribeQoS sets the maximum quality of service, 0, 1 or 2,
+// messages are delivered to the subscriber with
+func SubscribeQoS(qos byte) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, subscribeQoSKey{}, qos)
+	}
+}
+
+// PublishQoS sets the quality of service, 0, 1 or 2, the message is published with
+func PublishQoS(qos byte) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, publishQoSKey{}, qos)
+	}
+}
+
+// Retained publishes the message as retained. The server keeps the last
+// retained message of a topic and delivers it to new subscribers.
+func Retained() broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, retainedKey{}, true)
+	}
+}
@@ -0,0 +1,22 @@
+package nats
+
+import (
+	"os"
+	"testing"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("NATS_ADDR")
+	if addr == "" {
+		t.Skip("NATS_ADDR not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(broker.Addrs(addr))
+	},
+		conformance.Skip(conformance.AckRedelivery, "core NATS has no acks, use Streaming"),
+	)
+}
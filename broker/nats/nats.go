@@ -3,15 +3,18 @@ package nats
 import (
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/micro/go-micro/broker"
 	"github.com/micro/go-micro/cmd"
+	"github.com/nats-io/go-nats-streaming"
 	"github.com/nats-io/nats"
 )
 
 type nbroker struct {
 	addrs []string
 	conn  *nats.Conn
+	sconn stan.Conn
 	opts  broker.Options
 }
 
@@ -21,7 +24,9 @@ type subscriber struct {
 }
 
 type publication struct {
+	c *nats.Conn
 	t string
+	r string
 	m *broker.Message
 }
 
@@ -75,16 +80,96 @@ func (n *nbroker) Connect() error {
 		opts.Secure = true
 	}
 
+	n.setReconnect(&opts)
+	if timeout, ok := n.drainTimeout(); ok {
+		opts.DrainTimeout = timeout
+	}
+
 	c, err := opts.Connect()
 	if err != nil {
 		return err
 	}
 	n.conn = c
+
+	if s := n.streaming(); s != nil {
+		if err := n.connectStreaming(s); err != nil {
+			c.Close()
+			n.conn = nil
+			return err
+		}
+	}
 	return nil
 }
 
-func (n *nbroker) Disconnect() error {
+func (n *nbroker) drainTimeout() (time.Duration, bool) {
+	if n.opts.Context == nil {
+		return 0, false
+	}
+	timeout, ok := n.opts.Context.Value(drainKey{}).(time.Duration)
+	return timeout, ok
+}
+
+// setReconnect applies the reconnect settings and connection callbacks
+func (n *nbroker) setReconnect(opts *nats.Options) {
+	if n.opts.Context == nil {
+		return
+	}
+
+	if v, ok := n.opts.Context.Value(maxReconnectKey{}).(int); ok {
+		opts.MaxReconnect = v
+	}
+	if v, ok := n.opts.Context.Value(reconnectWaitKey{}).(time.Duration); ok {
+		opts.ReconnectWait = v
+	}
+	if v, ok := n.opts.Context.Value(reconnectBufSizeKey{}).(int); ok {
+		opts.ReconnectBufSize = v
+	}
+	if fn, ok := n.opts.Context.Value(disconnectHandlerKey{}).(func()); ok {
+		opts.DisconnectedCB = func(*nats.Conn) { fn() }
+	}
+	if fn, ok := n.opts.Context.Value(reconnectHandlerKey{}).(func()); ok {
+		opts.ReconnectedCB = func(*nats.Conn) { fn() }
+	}
+	if fn, ok := n.opts.Context.Value(closedHandlerKey{}).(func()); ok {
+		opts.ClosedCB = func(*nats.Conn) { fn() }
+	}
+}
+
+// drain drains the connection: the subscriptions stop receiving, the
+// messages already received are handled and the connection is closed.
+// It waits up to the drain timeout of the connection.
+func (n *nbroker) drain(timeout time.Duration) {
+	if err := n.conn.Drain(); err != nil {
+		n.conn.Close()
+		return
+	}
+
+	// the connection closes itself once drained or timed out
+	deadline := time.Now().Add(timeout + time.Second)
+	for !n.conn.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
 	n.conn.Close()
+}
+
+func (n *nbroker) Disconnect() error {
+	if n.conn == nil {
+		return nil
+	}
+
+	// streaming messages which aren't acked are redelivered
+	if n.sconn != nil {
+		n.sconn.Close()
+		n.sconn = nil
+	}
+
+	if timeout, ok := n.drainTimeout(); ok {
+		n.drain(timeout)
+	} else {
+		n.conn.Close()
+	}
+	// connect again on the next Connect
+	n.conn = nil
 	return nil
 }
 
@@ -100,14 +185,25 @@ func (n *nbroker) Options() broker.Options {
 }
 
 func (n *nbroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	if n.conn == nil {
+		return nats.ErrConnectionClosed
+	}
+
 	b, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
+	if n.sconn != nil {
+		return n.sconn.Publish(topic, b)
+	}
 	return n.conn.Publish(topic, b)
 }
 
 func (n *nbroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if n.conn == nil {
+		return nil, nats.ErrConnectionClosed
+	}
+
 	opt := broker.SubscribeOptions{
 		AutoAck: true,
 	}
@@ -116,12 +212,16 @@ func (n *nbroker) Subscribe(topic string, handler broker.Handler, opts ...broker
 		o(&opt)
 	}
 
+	if n.sconn != nil {
+		return n.subscribeStreaming(topic, handler, opt)
+	}
+
 	fn := func(msg *nats.Msg) {
 		var m *broker.Message
 		if err := json.Unmarshal(msg.Data, &m); err != nil {
 			return
 		}
-		handler(&publication{m: m, t: topic})
+		handler(&publication{c: n.conn, m: m, t: topic, r: msg.Reply})
 	}
 
 	var sub *nats.Subscription
@@ -135,6 +235,7 @@ func (n *nbroker) Subscribe(topic string, handler broker.Handler, opts ...broker
 	if err != nil {
 		return nil, err
 	}
+
 	return &subscriber{s: sub, opts: opt}, nil
 }
 
@@ -0,0 +1,126 @@
+package nats
+
+import (
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"golang.org/x/net/context"
+)
+
+type streamingKey struct{}
+
+type maxReconnectKey struct{}
+
+type reconnectWaitKey struct{}
+
+type reconnectBufSizeKey struct{}
+
+type disconnectHandlerKey struct{}
+
+type reconnectHandlerKey struct{}
+
+type closedHandlerKey struct{}
+
+type drainKey struct{}
+
+type startKey struct{}
+
+type streaming struct {
+	clusterID string
+	clientID  string
+}
+
+type start struct {
+	lastReceived bool
+	sequence     uint64
+	time         time.Time
+}
+
+func setBrokerOption(k, v interface{}) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+// MaxReconnect sets the number of reconnect attempts
+// before the connection is closed
+func MaxReconnect(n int) broker.Option {
+	return setBrokerOption(maxReconnectKey{}, n)
+}
+
+// ReconnectWait sets the delay between reconnect attempts
+func ReconnectWait(d time.Duration) broker.Option {
+	return setBrokerOption(reconnectWaitKey{}, d)
+}
+
+// ReconnectBufSize sets the size in bytes of the buffer
+// holding messages published while reconnecting
+func ReconnectBufSize(n int) broker.Option {
+	return setBrokerOption(reconnectBufSizeKey{}, n)
+}
+
+// DisconnectHandler is called when the connection to the server is lost
+func DisconnectHandler(fn func()) broker.Option {
+	return setBrokerOption(disconnectHandlerKey{}, fn)
+}
+
+// ReconnectHandler is called when the connection to the server is restored
+func ReconnectHandler(fn func()) broker.Option {
+	return setBrokerOption(reconnectHandlerKey{}, fn)
+}
+
+// ClosedHandler is called when the connection is closed for good, either
+// on Disconnect or once the reconnect attempts are exhausted
+func ClosedHandler(fn func()) broker.Option {
+	return setBrokerOption(closedHandlerKey{}, fn)
+}
+
+// Drain makes Disconnect drain the connection: subscribers stop receiving
+// and the messages already received are handled before the connection is
+// closed, waiting up to timeout. Streaming subscriptions are closed right
+// away, messages which weren't acked are redelivered by the server.
+func Drain(timeout time.Duration) broker.Option {
+	return setBrokerOption(drainKey{}, timeout)
+}
+
+// Streaming publishes and subscribes through NATS Streaming on the cluster
+// clusterID. Messages are persisted so offline subscribers receive them
+// once back. Subscribers with a queue are durable, the queue being the
+// durable name, and Ack is supported. The clientID has to be unique
+// within the cluster.
+func Streaming(clusterID, clientID string) broker.Option {
+	return setBrokerOption(streamingKey{}, &streaming{
+		clusterID: clusterID,
+		clientID:  clientID,
+	})
+}
+
+func setStart(s *start) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, startKey{}, s)
+	}
+}
+
+// StartWithLastReceived starts a streaming subscription
+// with the last message received on the topic.
+func StartWithLastReceived() broker.SubscribeOption {
+	return setStart(&start{lastReceived: true})
+}
+
+// StartAtSequence starts a streaming subscription at
+// the message with the given sequence number.
+func StartAtSequence(seq uint64) broker.SubscribeOption {
+	return setStart(&start{sequence: seq})
+}
+
+// StartAtTime starts a streaming subscription with
+// the first message received at or after t.
+func StartAtTime(t time.Time) broker.SubscribeOption {
+	return setStart(&start{time: t})
+}
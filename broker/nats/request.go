@@ -0,0 +1,77 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/nats-io/nats"
+)
+
+var (
+	// ErrNotSupported is returned for brokers and
+	// publications which are not of the nats broker
+	ErrNotSupported = errors.New("nats: not a nats broker or publication")
+	// ErrNoReply is returned when replying to a
+	// publication which was not sent as a request
+	ErrNoReply = errors.New("nats: publication has no reply subject")
+)
+
+// Request publishes the message on a core NATS connection and waits up to
+// timeout for the reply of a subscriber. It bypasses NATS Streaming, so
+// streaming subscribers do not receive requests.
+func (n *nbroker) Request(topic string, msg *broker.Message, timeout time.Duration) (*broker.Message, error) {
+	if n.conn == nil {
+		return nil, nats.ErrConnectionClosed
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := n.conn.Request(topic, b, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *broker.Message
+	if err := json.Unmarshal(rsp.Data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Respond sends msg as the reply to a publication sent with Request.
+func (n *publication) Respond(msg *broker.Message) error {
+	if len(n.r) == 0 {
+		return ErrNoReply
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return n.c.Publish(n.r, b)
+}
+
+// Request publishes the message through a nats broker and waits up to
+// timeout for the reply. Streaming subscribers do not receive requests.
+func Request(b broker.Broker, topic string, msg *broker.Message, timeout time.Duration) (*broker.Message, error) {
+	n, ok := b.(*nbroker)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return n.Request(topic, msg, timeout)
+}
+
+// Respond replies with msg to a publication which was sent with Request
+// and received by a handler of a nats broker.
+func Respond(p broker.Publication, msg *broker.Message) error {
+	n, ok := p.(*publication)
+	if !ok {
+		return ErrNotSupported
+	}
+	return n.Respond(msg)
+}
@@ -0,0 +1,124 @@
+package nats
+
+import (
+	"encoding/json"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/nats-io/go-nats-streaming"
+)
+
+type streamSubscriber struct {
+	s       stan.Subscription
+	t       string
+	durable bool
+	opts    broker.SubscribeOptions
+}
+
+type streamPublication struct {
+	t string
+	m *broker.Message
+	s *stan.Msg
+}
+
+func (n *streamPublication) Topic() string {
+	return n.t
+}
+
+func (n *streamPublication) Message() *broker.Message {
+	return n.m
+}
+
+func (n *streamPublication) Ack() error {
+	return n.s.Ack()
+}
+
+func (n *streamSubscriber) Options() broker.SubscribeOptions {
+	return n.opts
+}
+
+func (n *streamSubscriber) Topic() string {
+	return n.t
+}
+
+// Unsubscribe keeps the state of durable subscriptions
+// so they resume where they left off.
+func (n *streamSubscriber) Unsubscribe() error {
+	if n.durable {
+		return n.s.Close()
+	}
+	return n.s.Unsubscribe()
+}
+
+func (n *nbroker) streaming() *streaming {
+	if n.opts.Context == nil {
+		return nil
+	}
+	s, _ := n.opts.Context.Value(streamingKey{}).(*streaming)
+	return s
+}
+
+func (n *nbroker) connectStreaming(s *streaming) error {
+	sc, err := stan.Connect(s.clusterID, s.clientID, stan.NatsConn(n.conn))
+	if err != nil {
+		return err
+	}
+	n.sconn = sc
+	return nil
+}
+
+func (n *nbroker) subscribeStreaming(topic string, handler broker.Handler, opt broker.SubscribeOptions) (broker.Subscriber, error) {
+	// acks are sent by the handler or after it returned
+	opts := []stan.SubscriptionOption{
+		stan.SetManualAckMode(),
+	}
+
+	if len(opt.Queue) > 0 {
+		opts = append(opts, stan.DurableName(opt.Queue))
+	}
+
+	if opt.Context != nil {
+		if s, ok := opt.Context.Value(startKey{}).(*start); ok {
+			switch {
+			case s.lastReceived:
+				opts = append(opts, stan.StartWithLastReceived())
+			case s.sequence > 0:
+				opts = append(opts, stan.StartAtSequence(s.sequence))
+			case !s.time.IsZero():
+				opts = append(opts, stan.StartAtTime(s.time))
+			}
+		}
+	}
+
+	fn := func(msg *stan.Msg) {
+		var m *broker.Message
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			return
+		}
+		// unacked messages are redelivered
+		if err := handler(&streamPublication{m: m, t: topic, s: msg}); err != nil {
+			return
+		}
+		if opt.AutoAck {
+			msg.Ack()
+		}
+	}
+
+	var sub stan.Subscription
+	var err error
+
+	if len(opt.Queue) > 0 {
+		sub, err = n.sconn.QueueSubscribe(topic, opt.Queue, fn, opts...)
+	} else {
+		sub, err = n.sconn.Subscribe(topic, fn, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamSubscriber{
+		s:       sub,
+		t:       topic,
+		durable: len(opt.Queue) > 0,
+		opts:    opt,
+	}, nil
+}
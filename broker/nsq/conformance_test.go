@@ -0,0 +1,24 @@
+package nsq
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("NSQD_ADDR")
+	if addr == "" {
+		t.Skip("NSQD_ADDR not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(broker.Addrs(addr))
+	},
+		conformance.SubscribeOptions(RequeueBackoff(100*time.Millisecond, time.Second)),
+		conformance.Settle(time.Second),
+	)
+}
@@ -2,6 +2,7 @@ package nsq
 
 import (
 	"encoding/json"
+	"log"
 	"math/rand"
 	"sync"
 	"time"
@@ -35,6 +36,8 @@ type subscriber struct {
 	opts  broker.SubscribeOptions
 
 	c *nsq.Consumer
+	// config of the consumer
+	config *nsq.Config
 
 	// handler so we can resubcribe
 	h nsq.HandlerFunc
@@ -44,6 +47,9 @@ type subscriber struct {
 
 var (
 	DefaultConcurrentHandlers = 1
+	DefaultRequeueDelay       = time.Second
+	DefaultMaxRequeueDelay    = 10 * time.Minute
+	DefaultMaxAttempts        = uint16(5)
 )
 
 func init() {
@@ -93,7 +99,7 @@ func (n *nsqBroker) Connect() error {
 			channel = uuid.NewUUID().String()
 		}
 
-		cm, err := nsq.NewConsumer(c.topic, channel, n.config)
+		cm, err := nsq.NewConsumer(c.topic, channel, c.config)
 		if err != nil {
 			return err
 		}
@@ -102,8 +108,7 @@ func (n *nsqBroker) Connect() error {
 
 		c.c = cm
 
-		err = c.c.ConnectToNSQDs(n.addrs)
-		if err != nil {
+		if err := n.connectConsumer(c.c); err != nil {
 			return err
 		}
 	}
@@ -131,6 +136,12 @@ func (n *nsqBroker) Disconnect() error {
 		c.c.Stop()
 
 		// disconnect from all nsq brokers
+		if lookupd := n.lookupdAddrs(); len(lookupd) > 0 {
+			for _, addr := range lookupd {
+				c.c.DisconnectFromNSQLookupd(addr)
+			}
+			continue
+		}
 		for _, addr := range n.addrs {
 			c.c.DisconnectFromNSQD(addr)
 		}
@@ -148,9 +159,65 @@ func (n *nsqBroker) Publish(topic string, message *broker.Message, opts ...broke
 	if err != nil {
 		return err
 	}
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Context != nil {
+		if delay, ok := options.Context.Value(deferredPublishKey).(time.Duration); ok {
+			return p.DeferredPublish(topic, delay, b)
+		}
+	}
+
 	return p.Publish(topic, b)
 }
 
+func (n *nsqBroker) lookupdAddrs() []string {
+	if n.opts.Context == nil {
+		return nil
+	}
+	addrs, _ := n.opts.Context.Value(lookupdAddrsKey).([]string)
+	return addrs
+}
+
+// connectConsumer connects the consumer to the nsqlookupd
+// instances if set, or to the nsqd nodes otherwise
+func (n *nsqBroker) connectConsumer(c *nsq.Consumer) error {
+	if lookupd := n.lookupdAddrs(); len(lookupd) > 0 {
+		return c.ConnectToNSQLookupds(lookupd)
+	}
+	return c.ConnectToNSQDs(n.addrs)
+}
+
+// requeue requeues the message with exponential backoff or finishes
+// it once the max attempts are reached, zero max attempts never do
+func requeue(nm *nsq.Message, backoff *requeueBackoff, maxAttempts uint16) {
+	if maxAttempts > 0 && nm.Attempts >= maxAttempts {
+		log.Printf("nsq: giving up on message %s after %d attempts", nm.ID, nm.Attempts)
+		nm.Finish()
+		return
+	}
+
+	nm.RequeueWithoutBackoff(requeueDelay(nm.Attempts, backoff))
+}
+
+// requeueDelay returns the delay of the attempt, doubling
+// the backoff delay with every attempt up to its max
+func requeueDelay(attempts uint16, backoff *requeueBackoff) time.Duration {
+	delay := backoff.max
+	if attempts == 0 {
+		attempts = 1
+	}
+	if shift := attempts - 1; shift < 32 {
+		if d := backoff.delay << shift; d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
 func (n *nsqBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
 	options := broker.SubscribeOptions{
 		AutoAck: true,
@@ -162,12 +229,24 @@ func (n *nsqBroker) Subscribe(topic string, handler broker.Handler, opts ...brok
 
 	var concurrency int
 
+	backoff := &requeueBackoff{
+		delay: DefaultRequeueDelay,
+		max:   DefaultMaxRequeueDelay,
+	}
+	maxAttempts := DefaultMaxAttempts
+
 	if options.Context != nil {
 		var ok bool
 		concurrency, ok = options.Context.Value(concurrentHandlerKey).(int)
 		if !ok {
 			concurrency = DefaultConcurrentHandlers
 		}
+		if b, ok := options.Context.Value(requeueBackoffKey).(*requeueBackoff); ok {
+			backoff = b
+		}
+		if m, ok := options.Context.Value(maxAttemptsKey).(uint16); ok {
+			maxAttempts = m
+		}
 	} else {
 		concurrency = DefaultConcurrentHandlers
 
@@ -178,42 +257,65 @@ func (n *nsqBroker) Subscribe(topic string, handler broker.Handler, opts ...brok
 		channel = uuid.NewUUID().String()
 	}
 
-	c, err := nsq.NewConsumer(topic, channel, n.config)
+	// The consumer finishes messages once the MaxAttempts of its config
+	// are reached, before they are handled. Leave it to requeue.
+	config := *n.config
+	config.MaxAttempts = 0
+
+	c, err := nsq.NewConsumer(topic, channel, &config)
 	if err != nil {
 		return nil, err
 	}
 
 	h := nsq.HandlerFunc(func(nm *nsq.Message) error {
-		if !options.AutoAck {
-			nm.DisableAutoResponse()
+		// responses are sent below or by the handler
+		nm.DisableAutoResponse()
+
+		// redelivered after timing out, as the consumer would
+		// without max attempts in its config
+		if maxAttempts > 0 && nm.Attempts > maxAttempts {
+			log.Printf("nsq: giving up on message %s after %d attempts", nm.ID, nm.Attempts)
+			nm.Finish()
+			return nil
 		}
 
 		var m *broker.Message
 
 		if err := json.Unmarshal(nm.Body, &m); err != nil {
+			// can't ever be handled
+			nm.Finish()
 			return err
 		}
 
-		return handler(&publication{
+		if err := handler(&publication{
 			topic: topic,
 			m:     m,
 			nm:    nm,
-		})
+		}); err != nil {
+			if !nm.HasResponded() {
+				requeue(nm, backoff, maxAttempts)
+			}
+			return err
+		}
 
+		if options.AutoAck && !nm.HasResponded() {
+			nm.Finish()
+		}
+		return nil
 	})
 
 	c.AddConcurrentHandlers(h, concurrency)
 
-	err = c.ConnectToNSQDs(n.addrs)
-	if err != nil {
+	if err := n.connectConsumer(c); err != nil {
 		return nil, err
 	}
 
 	return &subscriber{
-		topic: topic,
-		c:     c,
-		h:     h,
-		n:     concurrency,
+		topic:  topic,
+		c:      c,
+		config: &config,
+		h:      h,
+		n:      concurrency,
 	}, nil
 }
 
@@ -0,0 +1,137 @@
+package nsq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/nsqio/go-nsq"
+)
+
+// testDelegate records the response to a message
+type testDelegate struct {
+	finished bool
+	requeued bool
+	delay    time.Duration
+}
+
+func (d *testDelegate) OnFinish(*nsq.Message) {
+	d.finished = true
+}
+
+func (d *testDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.requeued = true
+	d.delay = delay
+}
+
+func (d *testDelegate) OnTouch(*nsq.Message) {}
+
+func TestRequeueDelay(t *testing.T) {
+	backoff := &requeueBackoff{
+		delay: time.Second,
+		max:   time.Minute,
+	}
+
+	testcases := []struct {
+		attempts uint16
+		delay    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{40, time.Minute},
+		{65535, time.Minute},
+	}
+
+	for _, test := range testcases {
+		if d := requeueDelay(test.attempts, backoff); d != test.delay {
+			t.Errorf("attempt %d: expected delay %v, got %v", test.attempts, test.delay, d)
+		}
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	backoff := &requeueBackoff{
+		delay: time.Second,
+		max:   time.Minute,
+	}
+
+	testcases := []struct {
+		name        string
+		attempts    uint16
+		maxAttempts uint16
+		finished    bool
+		delay       time.Duration
+	}{
+		{"first attempt", 1, 5, false, time.Second},
+		{"retried", 3, 5, false, 4 * time.Second},
+		{"max attempts", 5, 5, true, 0},
+		{"over max attempts", 6, 5, true, 0},
+		{"unlimited", 100, 0, false, time.Minute},
+	}
+
+	for _, test := range testcases {
+		d := &testDelegate{}
+		nm := nsq.NewMessage(nsq.MessageID{}, nil)
+		nm.Attempts = test.attempts
+		nm.Delegate = d
+
+		requeue(nm, backoff, test.maxAttempts)
+
+		if d.finished != test.finished {
+			t.Errorf("%s: expected finished %v, got %v", test.name, test.finished, d.finished)
+		}
+		if d.requeued == test.finished {
+			t.Errorf("%s: expected requeued %v, got %v", test.name, !test.finished, d.requeued)
+		}
+		if d.delay != test.delay {
+			t.Errorf("%s: expected delay %v, got %v", test.name, test.delay, d.delay)
+		}
+	}
+}
+
+func TestSubscribeOptions(t *testing.T) {
+	var options broker.SubscribeOptions
+	for _, o := range []broker.SubscribeOption{
+		RequeueBackoff(time.Second, time.Minute),
+		MaxAttempts(3),
+	} {
+		o(&options)
+	}
+
+	b, ok := options.Context.Value(requeueBackoffKey).(*requeueBackoff)
+	if !ok || b.delay != time.Second || b.max != time.Minute {
+		t.Fatalf("expected requeue backoff 1s up to 1m, got %+v", b)
+	}
+
+	if n, ok := options.Context.Value(maxAttemptsKey).(uint16); !ok || n != 3 {
+		t.Fatalf("expected max attempts 3, got %v", n)
+	}
+}
+
+func TestDeferredPublish(t *testing.T) {
+	var options broker.PublishOptions
+	DeferredPublish(time.Minute)(&options)
+
+	if d, ok := options.Context.Value(deferredPublishKey).(time.Duration); !ok || d != time.Minute {
+		t.Fatalf("expected deferred publish delay 1m, got %v", d)
+	}
+}
+
+func TestLookupdAddrs(t *testing.T) {
+	n := NewBroker().(*nsqBroker)
+	if addrs := n.lookupdAddrs(); addrs != nil {
+		t.Fatalf("expected no lookupd addresses, got %v", addrs)
+	}
+
+	exp := []string{"127.0.0.1:4161", "127.0.0.1:4261"}
+
+	n = NewBroker(LookupdAddrs(exp...)).(*nsqBroker)
+	if addrs := n.lookupdAddrs(); !reflect.DeepEqual(addrs, exp) {
+		t.Fatalf("expected lookupd addresses %v, got %v", exp, addrs)
+	}
+}
@@ -1,6 +1,8 @@
 package nsq
 
 import (
+	"time"
+
 	"github.com/micro/go-micro/broker"
 
 	"golang.org/x/net/context"
@@ -10,10 +12,67 @@ type contextKeyT string
 
 var (
 	concurrentHandlerKey = contextKeyT("github.com/micro/go-plugins/broker/nsq/concurrentHandlers")
+	deferredPublishKey   = contextKeyT("github.com/micro/go-plugins/broker/nsq/deferredPublish")
+	requeueBackoffKey    = contextKeyT("github.com/micro/go-plugins/broker/nsq/requeueBackoff")
+	maxAttemptsKey       = contextKeyT("github.com/micro/go-plugins/broker/nsq/maxAttempts")
+	lookupdAddrsKey      = contextKeyT("github.com/micro/go-plugins/broker/nsq/lookupdAddrs")
 )
 
+type requeueBackoff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
 func ConcurrentHandlers(n int) broker.SubscribeOption {
 	return func(o *broker.SubscribeOptions) {
 		o.Context = context.WithValue(o.Context, concurrentHandlerKey, n)
 	}
 }
+
+// DeferredPublish publishes the message with DPUB so
+// it is delivered once the delay has passed
+func DeferredPublish(delay time.Duration) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, deferredPublishKey, delay)
+	}
+}
+
+// RequeueBackoff requeues messages the handler returned an error for
+// after delay, doubling it with every attempt up to max
+func RequeueBackoff(delay, max time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, requeueBackoffKey, &requeueBackoff{
+			delay: delay,
+			max:   max,
+		})
+	}
+}
+
+// MaxAttempts sets the number of attempts after which a message the
+// handler keeps failing on is finished instead of requeued
+func MaxAttempts(n uint16) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxAttemptsKey, n)
+	}
+}
+
+// LookupdAddrs makes subscribers discover the nsqd nodes of a
+// topic through the nsqlookupd instances at the given addresses
+// instead of connecting to the broker addresses
+func LookupdAddrs(addrs ...string) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, lookupdAddrsKey, addrs)
+	}
+}
@@ -0,0 +1,45 @@
+package outbox
+
+import (
+	"sync"
+)
+
+// dedupe remembers the last size message ids
+type dedupe struct {
+	sync.Mutex
+	size int
+	ids  map[string]bool
+	// ids in the order they were added
+	order []string
+}
+
+func newDedupe(size int) *dedupe {
+	return &dedupe{
+		size: size,
+		ids:  make(map[string]bool, size),
+	}
+}
+
+func (d *dedupe) seen(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.ids[id]
+}
+
+// add remembers the id, forgetting the oldest if full
+func (d *dedupe) add(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.size <= 0 || d.ids[id] {
+		return
+	}
+
+	if len(d.order) >= d.size {
+		delete(d.ids, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	d.ids[id] = true
+	d.order = append(d.order, id)
+}
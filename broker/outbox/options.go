@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"golang.org/x/net/context"
+)
+
+var (
+	// DefaultPath is the file the outbox log is written to
+	DefaultPath = "outbox.log"
+	// DefaultRelayBackoff is the delay before the relay retries
+	// a publication the wrapped broker failed to publish
+	DefaultRelayBackoff = time.Second
+	// DefaultDedupeSize is the number of message ids
+	// a subscriber remembers to drop duplicates
+	DefaultDedupeSize = 1000
+	// DefaultCompactThreshold is the number of acked publications
+	// in the log which triggers its compaction
+	DefaultCompactThreshold = 1000
+)
+
+type pathKey struct{}
+
+type relayBackoffKey struct{}
+
+type dedupeSizeKey struct{}
+
+type compactThresholdKey struct{}
+
+func setBrokerOption(k, v interface{}) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+// Path sets the file the outbox log is written to. Publications
+// which weren't relayed are read from it on Connect, so it has to
+// be kept across restarts.
+func Path(path string) broker.Option {
+	return setBrokerOption(pathKey{}, path)
+}
+
+// RelayBackoff sets the delay before the relay retries
+// a publication the wrapped broker failed to publish
+func RelayBackoff(d time.Duration) broker.Option {
+	return setBrokerOption(relayBackoffKey{}, d)
+}
+
+// DedupeSize sets the number of message ids a subscriber
+// remembers to drop duplicate deliveries
+func DedupeSize(n int) broker.Option {
+	return setBrokerOption(dedupeSizeKey{}, n)
+}
+
+// CompactThreshold sets the number of acked publications in the log
+// which triggers its compaction. The log is rewritten with the pending
+// publications only, it's truncated whenever none is pending anyway.
+func CompactThreshold(n int) broker.Option {
+	return setBrokerOption(compactThresholdKey{}, n)
+}
@@ -0,0 +1,519 @@
+package outbox
+
+/*
+	Outbox is a go-micro Broker wrapper making publishing durable.
+
+	Publish appends the message to a local log file and syncs it
+	to disk before returning. A background relay then publishes
+	the messages of the log, in order, through the wrapped broker
+	and retries until it succeeds. Messages which weren't relayed
+	before a crash or a Disconnect are relayed once connected again.
+
+	Delivery is at least once. Every message is given a unique
+	MessageIdHeader, unless it has one already, and subscribers
+	of the outbox drop messages with an id they recently handled.
+	Publishing a message with the id of a message still in the
+	outbox is a no-op.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/pborman/uuid"
+)
+
+// MessageIdHeader is the header holding the
+// id messages are deduplicated by
+const MessageIdHeader = "Message-Id"
+
+// ErrPublishOptions is returned by Publish when publish options
+// are passed, they can't be written to the log
+var ErrPublishOptions = errors.New("outbox: publish options are not supported")
+
+type outbox struct {
+	b    broker.Broker
+	opts broker.Options
+
+	sync.Mutex
+	connected bool
+	f         *os.File
+	// publications not relayed yet, oldest first
+	pending []*record
+	ids     map[string]bool
+	// acked publications still in the log
+	acked int
+
+	notify chan bool
+	exit   chan bool
+	done   chan bool
+}
+
+// record is an entry of the outbox log, either a publication
+// or the ack of a publication which was relayed
+type record struct {
+	Id      string          `json:"id"`
+	Topic   string          `json:"topic,omitempty"`
+	Message *broker.Message `json:"message,omitempty"`
+	Ack     bool            `json:"ack,omitempty"`
+}
+
+func (o *outbox) path() string {
+	if o.opts.Context != nil {
+		if p, ok := o.opts.Context.Value(pathKey{}).(string); ok {
+			return p
+		}
+	}
+	return DefaultPath
+}
+
+func (o *outbox) relayBackoff() time.Duration {
+	if o.opts.Context != nil {
+		if d, ok := o.opts.Context.Value(relayBackoffKey{}).(time.Duration); ok {
+			return d
+		}
+	}
+	return DefaultRelayBackoff
+}
+
+func (o *outbox) dedupeSize() int {
+	if o.opts.Context != nil {
+		if n, ok := o.opts.Context.Value(dedupeSizeKey{}).(int); ok {
+			return n
+		}
+	}
+	return DefaultDedupeSize
+}
+
+func (o *outbox) compactThreshold() int {
+	if o.opts.Context != nil {
+		if n, ok := o.opts.Context.Value(compactThresholdKey{}).(int); ok {
+			return n
+		}
+	}
+	return DefaultCompactThreshold
+}
+
+// replay reads the log and returns the publications which weren't
+// acked and the number of those which were. A final record torn by a
+// crash while writing it is dropped, it was never acknowledged to the
+// publisher. Other records which can't be read are skipped.
+func replay(f *os.File) ([]*record, int, error) {
+	var records []*record
+	acked := make(map[string]bool)
+
+	var offset int64
+	rd := bufio.NewReader(f)
+
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		offset += int64(len(line))
+
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			log.Printf("outbox: skipping invalid record at offset %d: %v", offset-int64(len(line)), err)
+			continue
+		}
+
+		if r.Ack {
+			acked[r.Id] = true
+			continue
+		}
+		records = append(records, &r)
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		return nil, 0, err
+	}
+
+	var pending []*record
+	for _, r := range records {
+		if !acked[r.Id] {
+			pending = append(pending, r)
+		}
+	}
+	return pending, len(records) - len(pending), nil
+}
+
+// write appends the record to the log, syncing it to disk if flush is
+// set. On error the log is truncated to where the record started, so a
+// partial record isn't followed by the next ones.
+func (o *outbox) write(r *record, flush bool) error {
+	offset, err := o.f.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+
+	err = writeRecord(o.f, r)
+	if err == nil && flush {
+		err = o.f.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+
+	if terr := o.f.Truncate(offset); terr != nil {
+		log.Printf("outbox: error truncating %s: %v", o.path(), terr)
+	} else if _, serr := o.f.Seek(offset, 0); serr != nil {
+		log.Printf("outbox: error seeking %s: %v", o.path(), serr)
+	}
+	return err
+}
+
+func writeRecord(w io.Writer, r *record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// compact rewrites the log with the pending publications only. They are
+// written to a temporary file which replaces the log, so a crash leaves
+// either the old or the new log. Called with the lock held.
+func (o *outbox) compact() error {
+	tmp := o.path() + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, r := range o.pending {
+		if err = writeRecord(w, r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, o.path())
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// f is at the end of the new log
+	o.f.Close()
+	o.f = f
+	o.acked = 0
+	return nil
+}
+
+// next returns the oldest publication not relayed yet
+func (o *outbox) next() *record {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.pending) == 0 {
+		return nil
+	}
+	return o.pending[0]
+}
+
+// ack marks the oldest publication as relayed. The ack isn't synced,
+// if it's lost the publication is relayed again. The log is truncated
+// once all publications were relayed and compacted once the number of
+// acked publications in it reaches the compact threshold.
+func (o *outbox) ack(r *record) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.pending = o.pending[1:]
+	delete(o.ids, r.Id)
+
+	if len(o.pending) == 0 {
+		if err := o.f.Truncate(0); err != nil {
+			return err
+		}
+		o.acked = 0
+		_, err := o.f.Seek(0, 0)
+		return err
+	}
+
+	o.acked++
+	if o.acked >= o.compactThreshold() {
+		err := o.compact()
+		if err == nil {
+			return nil
+		}
+		log.Printf("outbox: error compacting %s: %v", o.path(), err)
+	}
+	return o.write(&record{Id: r.Id, Ack: true}, false)
+}
+
+// relay publishes the pending publications through the wrapped broker
+// until exit is closed
+func (o *outbox) relay(exit, done chan bool) {
+	defer close(done)
+
+	for {
+		select {
+		case <-exit:
+			return
+		default:
+		}
+
+		r := o.next()
+		if r == nil {
+			select {
+			case <-exit:
+				return
+			case <-o.notify:
+			}
+			continue
+		}
+
+		if err := o.b.Publish(r.Topic, r.Message); err != nil {
+			log.Printf("outbox: relay error publishing %s to %s: %v", r.Id, r.Topic, err)
+			select {
+			case <-exit:
+				return
+			case <-time.After(o.relayBackoff()):
+			}
+			continue
+		}
+
+		if err := o.ack(r); err != nil {
+			log.Printf("outbox: error acking %s: %v", r.Id, err)
+		}
+	}
+}
+
+func (o *outbox) Options() broker.Options {
+	return o.opts
+}
+
+func (o *outbox) Address() string {
+	return o.b.Address()
+}
+
+// Connect connects the wrapped broker, opens the log
+// and starts relaying the publications in it
+func (o *outbox) Connect() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		return nil
+	}
+
+	if err := o.b.Connect(); err != nil {
+		return err
+	}
+
+	if err := o.open(); err != nil {
+		o.b.Disconnect()
+		return err
+	}
+
+	o.exit = make(chan bool)
+	o.done = make(chan bool)
+	o.connected = true
+
+	go o.relay(o.exit, o.done)
+
+	return nil
+}
+
+// open opens and replays the log, compacting it if needed.
+// Called with the lock held.
+func (o *outbox) open() error {
+	f, err := os.OpenFile(o.path(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	pending, acked, err := replay(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	o.f = f
+	o.pending = pending
+	o.acked = acked
+	o.ids = make(map[string]bool, len(pending))
+	for _, r := range pending {
+		o.ids[r.Id] = true
+	}
+
+	if o.acked >= o.compactThreshold() {
+		if err := o.compact(); err != nil {
+			o.f.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Disconnect stops the relay and disconnects the wrapped broker.
+// Publications not relayed yet are kept in the log.
+func (o *outbox) Disconnect() error {
+	o.Lock()
+	if !o.connected {
+		o.Unlock()
+		return nil
+	}
+	close(o.exit)
+	done := o.done
+	o.connected = false
+	o.Unlock()
+
+	// wait for a publication in progress
+	<-done
+
+	o.Lock()
+	err := o.f.Close()
+	o.Unlock()
+
+	if berr := o.b.Disconnect(); berr != nil {
+		return berr
+	}
+	return err
+}
+
+// Init sets the options of the outbox and of the wrapped broker
+func (o *outbox) Init(opts ...broker.Option) error {
+	for _, opt := range opts {
+		opt(&o.opts)
+	}
+	return o.b.Init(opts...)
+}
+
+// Publish writes the message to the log. It is published by the relay
+// once Publish returned. Publish options can't be written to the log,
+// ErrPublishOptions is returned rather than dropping them.
+func (o *outbox) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	if len(opts) > 0 {
+		return ErrPublishOptions
+	}
+
+	header := make(map[string]string, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+
+	id := header[MessageIdHeader]
+	if len(id) == 0 {
+		id = uuid.NewUUID().String()
+		header[MessageIdHeader] = id
+	}
+
+	r := &record{
+		Id:    id,
+		Topic: topic,
+		Message: &broker.Message{
+			Header: header,
+			Body:   msg.Body,
+		},
+	}
+
+	o.Lock()
+	if !o.connected {
+		o.Unlock()
+		return errors.New("not connected")
+	}
+
+	// already in the outbox
+	if o.ids[id] {
+		o.Unlock()
+		return nil
+	}
+
+	if err := o.write(r, true); err != nil {
+		o.Unlock()
+		return err
+	}
+
+	o.pending = append(o.pending, r)
+	o.ids[id] = true
+	o.Unlock()
+
+	select {
+	case o.notify <- true:
+	default:
+	}
+
+	return nil
+}
+
+// Subscribe subscribes through the wrapped broker. Messages
+// with the id of a message the handler recently handled are
+// dropped.
+func (o *outbox) Subscribe(topic string, h broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	options := broker.SubscribeOptions{
+		AutoAck: true,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	d := newDedupe(o.dedupeSize())
+
+	return o.b.Subscribe(topic, func(p broker.Publication) error {
+		id := p.Message().Header[MessageIdHeader]
+		if len(id) == 0 {
+			return h(p)
+		}
+
+		if d.seen(id) {
+			// drop the duplicate
+			if options.AutoAck {
+				return nil
+			}
+			return p.Ack()
+		}
+
+		if err := h(p); err != nil {
+			return err
+		}
+
+		d.add(id)
+		return nil
+	}, opts...)
+}
+
+func (o *outbox) String() string {
+	return "outbox"
+}
+
+// NewBroker returns a broker publishing
+// through an outbox to the broker b
+func NewBroker(b broker.Broker, opts ...broker.Option) broker.Broker {
+	var options broker.Options
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return &outbox{
+		b:      b,
+		opts:   options,
+		notify: make(chan bool, 1),
+	}
+}
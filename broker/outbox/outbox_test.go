@@ -0,0 +1,303 @@
+package outbox
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/memory"
+)
+
+// failBroker fails to publish until fail is unset
+type failBroker struct {
+	broker.Broker
+
+	sync.Mutex
+	fail bool
+}
+
+func (f *failBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.fail {
+		return errors.New("fail")
+	}
+	return f.Broker.Publish(topic, msg, opts...)
+}
+
+func (f *failBroker) setFail(fail bool) {
+	f.Lock()
+	f.fail = fail
+	f.Unlock()
+}
+
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "outbox.log"), func() { os.RemoveAll(dir) }
+}
+
+// waitPublished waits for n messages to be published on the topic
+func waitPublished(t *testing.T, b broker.Broker, topic string, n int) []*broker.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := memory.Published(b, topic); len(msgs) >= n {
+			return msgs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d messages on %s", n, topic)
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	m := memory.NewBroker()
+	b := NewBroker(m, Path(path))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	if err := b.Publish("foo", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := waitPublished(t, m, "foo", 1)
+
+	if string(msgs[0].Body) != "hello" {
+		t.Fatalf("Expected body hello got %s", string(msgs[0].Body))
+	}
+
+	if len(msgs[0].Header[MessageIdHeader]) == 0 {
+		t.Fatal("Expected message id header to be set")
+	}
+}
+
+func TestRelayAfterRestart(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	m := memory.NewBroker()
+	f := &failBroker{Broker: m, fail: true}
+	b := NewBroker(f, Path(path), RelayBackoff(10*time.Millisecond))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if err := b.Publish("foo", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := memory.Published(m, "foo"); len(msgs) != 0 {
+		t.Fatalf("Expected no messages published got %d", len(msgs))
+	}
+
+	// a new outbox relays what the last one didn't
+	f.setFail(false)
+	b = NewBroker(f, Path(path))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	msgs := waitPublished(t, m, "foo", 2)
+
+	if string(msgs[0].Body) != "1" || string(msgs[1].Body) != "2" {
+		t.Fatalf("Expected messages 1 and 2 in order got %s and %s", string(msgs[0].Body), string(msgs[1].Body))
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	m := memory.NewBroker()
+	b := NewBroker(m, Path(path))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	var handled int
+	if _, err := b.Subscribe("foo", func(p broker.Publication) error {
+		handled++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &broker.Message{
+		Header: map[string]string{MessageIdHeader: "1"},
+	}
+
+	// delivered twice by the wrapped broker
+	for i := 0; i < 2; i++ {
+		if err := memory.Deliver(m, "foo", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if handled != 1 {
+		t.Fatalf("Expected message to be handled once got %d", handled)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	m := memory.NewBroker()
+	f := &failBroker{Broker: m, fail: true}
+	b := NewBroker(f, Path(path), RelayBackoff(time.Hour), CompactThreshold(2))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"1", "2", "3", "4"} {
+		if err := b.Publish("foo", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// relay the first two, the relay itself is backing off
+	o := b.(*outbox)
+	for i := 0; i < 2; i++ {
+		if err := o.ack(o.next()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := bytes.Count(data, []byte("\n")); n != 2 {
+		t.Fatalf("Expected 2 records in the compacted log got %d", n)
+	}
+
+	f.setFail(false)
+	b = NewBroker(f, Path(path))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	msgs := waitPublished(t, m, "foo", 2)
+
+	if string(msgs[0].Body) != "3" || string(msgs[1].Body) != "4" {
+		t.Fatalf("Expected messages 3 and 4 in order got %s and %s", string(msgs[0].Body), string(msgs[1].Body))
+	}
+}
+
+func TestReplaySkipsInvalidRecords(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	content := `{"id":"1","topic":"foo","message":{"body":"MQ=="}}
+not a record
+{"id":"2","topic":"foo","message":{"body":"Mg=="}}
+{"id":"3","topic":"fo`
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pending, _, err := replay(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 2 || pending[0].Id != "1" || pending[1].Id != "2" {
+		t.Fatalf("Expected records 1 and 2 got %v", pending)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the torn record is truncated
+	if !bytes.HasSuffix(data, []byte("}\n")) {
+		t.Fatalf("Expected the torn record to be truncated got %q", data)
+	}
+}
+
+func TestPublishOptions(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	m := memory.NewBroker()
+	b := NewBroker(m, Path(path))
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	err := b.Publish("foo", &broker.Message{Body: []byte("hello")}, func(o *broker.PublishOptions) {})
+	if err != ErrPublishOptions {
+		t.Fatalf("Expected %v got %v", ErrPublishOptions, err)
+	}
+}
+
+// disconnectBroker records whether it was disconnected
+type disconnectBroker struct {
+	broker.Broker
+	disconnected bool
+}
+
+func (d *disconnectBroker) Disconnect() error {
+	d.disconnected = true
+	return d.Broker.Disconnect()
+}
+
+func TestConnectError(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	d := &disconnectBroker{Broker: memory.NewBroker()}
+	// the log can't be created in a missing directory
+	b := NewBroker(d, Path(filepath.Join(path, "missing", "outbox.log")))
+
+	if err := b.Connect(); err == nil {
+		t.Fatal("Expected an error opening the log")
+	}
+
+	if !d.disconnected {
+		t.Fatal("Expected the wrapped broker to be disconnected")
+	}
+}
@@ -6,15 +6,30 @@ package rabbitmq
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/nu7hatch/gouuid"
 	"github.com/streadway/amqp"
 )
 
+var (
+	ErrNack        = errors.New("rabbitmq: message nacked by broker")
+	ErrUnroutable  = errors.New("rabbitmq: message returned unroutable")
+	ErrConfirmWait = errors.New("rabbitmq: timeout waiting for publisher confirm")
+	ErrMandatory   = errors.New("rabbitmq: mandatory requires publisher confirms")
+)
+
 type rabbitMQChannel struct {
 	uuid       string
 	connection *amqp.Connection
 	channel    *amqp.Channel
+
+	// publisher confirms
+	mtx      sync.Mutex
+	seq      uint64
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
 }
 
 func newRabbitChannel(conn *amqp.Connection) (*rabbitMQChannel, error) {
@@ -56,42 +71,121 @@ func (r *rabbitMQChannel) Publish(exchange, key string, message amqp.Publishing)
 	return r.channel.Publish(exchange, key, false, false, message)
 }
 
-func (r *rabbitMQChannel) DeclareExchange(exchange string) error {
+// Confirm puts the channel into confirm mode
+func (r *rabbitMQChannel) Confirm() error {
+	if err := r.channel.Confirm(false); err != nil {
+		return err
+	}
+	// buffered so late confirms of timed out publishings don't block the connection
+	r.confirms = r.channel.NotifyPublish(make(chan amqp.Confirmation, 100))
+	r.returns = r.channel.NotifyReturn(make(chan amqp.Return, 100))
+	return nil
+}
+
+// PublishConfirm publishes the message and waits until the broker confirms
+// it. A mandatory message which can't be routed is returned as an error.
+func (r *rabbitMQChannel) PublishConfirm(exchange, key string, mandatory bool, message amqp.Publishing, timeout time.Duration) error {
+	if r.channel == nil {
+		return errors.New("Channel is nil")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	// drop returns of publishings which timed out
+	for len(r.returns) > 0 {
+		<-r.returns
+	}
+
+	if err := r.channel.Publish(exchange, key, mandatory, false, message); err != nil {
+		return err
+	}
+
+	r.seq++
+
+	var returned bool
+	after := time.After(timeout)
+
+	for {
+		select {
+		// a return is sent before the confirm of the message
+		case <-r.returns:
+			returned = true
+		case c, ok := <-r.confirms:
+			if !ok {
+				return errors.New("Channel is closed")
+			}
+			// late confirm of a publishing which timed out
+			if c.DeliveryTag < r.seq {
+				continue
+			}
+			if !c.Ack {
+				return ErrNack
+			}
+			// the return may be pending if the confirm was selected first
+			select {
+			case <-r.returns:
+				returned = true
+			default:
+			}
+			if returned {
+				return ErrUnroutable
+			}
+			return nil
+		case <-after:
+			return ErrConfirmWait
+		}
+	}
+}
+
+func (r *rabbitMQChannel) DeclareExchange(ex exchange) error {
 	return r.channel.ExchangeDeclare(
-		exchange, // name
-		"topic",  // kind
-		false,    // durable
-		false,    // autoDelete
-		false,    // internal
-		false,    // noWait
-		nil,      // args
+		ex.name,    // name
+		ex.kind,    // kind
+		ex.durable, // durable
+		false,      // autoDelete
+		false,      // internal
+		false,      // noWait
+		nil,        // args
 	)
 }
 
-func (r *rabbitMQChannel) DeclareQueue(queue string) error {
+func (r *rabbitMQChannel) DeclareQueue(queue string, args amqp.Table) error {
 	_, err := r.channel.QueueDeclare(
 		queue, // name
 		false, // durable
 		true,  // autoDelete
 		false, // exclusive
 		false, // noWait
-		nil,   // args
+		args,  // args
 	)
 	return err
 }
 
-func (r *rabbitMQChannel) DeclareDurableQueue(queue string) error {
+func (r *rabbitMQChannel) DeclareDurableQueue(queue string, args amqp.Table) error {
 	_, err := r.channel.QueueDeclare(
 		queue, // name
 		true,  // durable
 		false, // autoDelete
 		false, // exclusive
 		false, // noWait
-		nil,   // args
+		args,  // args
 	)
 	return err
 }
 
+// DeclareDeadLetter declares a durable exchange and a durable queue of
+// the same name which collects all messages sent to the exchange
+func (r *rabbitMQChannel) DeclareDeadLetter(name string) error {
+	if err := r.DeclareExchange(exchange{name: name, kind: "topic", durable: true}); err != nil {
+		return err
+	}
+	if err := r.DeclareDurableQueue(name, nil); err != nil {
+		return err
+	}
+	return r.BindQueue(name, "#", name, nil)
+}
+
 func (r *rabbitMQChannel) DeclareReplyQueue(queue string) error {
 	_, err := r.channel.QueueDeclare(
 		queue, // name
@@ -116,12 +210,20 @@ func (r *rabbitMQChannel) ConsumeQueue(queue string, autoAck bool) (<-chan amqp.
 	)
 }
 
-func (r *rabbitMQChannel) BindQueue(queue, key, exchange string) error {
+func (r *rabbitMQChannel) BindQueue(queue, key, exchange string, args amqp.Table) error {
 	return r.channel.QueueBind(
 		queue,    // name
 		key,      // key
 		exchange, // exchange
 		false,    // noWait
-		nil,      // args
+		args,     // args
+	)
+}
+
+func (r *rabbitMQChannel) Qos(prefetchCount int) error {
+	return r.channel.Qos(
+		prefetchCount, // prefetchCount
+		0,             // prefetchSize
+		false,         // global
 	)
 }
@@ -0,0 +1,22 @@
+package rabbitmq
+
+import (
+	"os"
+	"testing"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	url := os.Getenv("RABBITMQ_URL")
+	if url == "" {
+		t.Skip("RABBITMQ_URL not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(broker.Addrs(url))
+	},
+		conformance.SubscribeOptions(RequeueOnError()),
+	)
+}
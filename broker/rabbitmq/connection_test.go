@@ -22,7 +22,7 @@ func TestNewRabbitMQConnURL(t *testing.T) {
 	}
 
 	for _, test := range testcases {
-		conn := newRabbitMQConn("exchange", test.urls)
+		conn := newRabbitMQConn(exchange{name: "exchange"}, test.urls)
 
 		if have, want := conn.url, test.want; have != want {
 			t.Errorf("%s: invalid url, want %q, have %q", test.title, want, have)
@@ -63,7 +63,7 @@ func TestTryToConnectTLS(t *testing.T) {
 	for _, test := range testcases {
 		dialCount, dialTLSCount = 0, 0
 
-		conn := newRabbitMQConn("exchange", []string{test.url})
+		conn := newRabbitMQConn(exchange{name: "exchange"}, []string{test.url})
 		conn.tryToConnect(test.secure, test.tlsConfig)
 
 		have := dialCount
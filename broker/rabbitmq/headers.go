@@ -0,0 +1,202 @@
+package rabbitmq
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/streadway/amqp"
+)
+
+// Headers the message properties are mapped to
+const (
+	ContentTypeHeader     = "Content-Type"
+	ContentEncodingHeader = "Content-Encoding"
+	DeliveryModeHeader    = "Delivery-Mode"
+	PriorityHeader        = "Priority"
+	CorrelationIdHeader   = "Correlation-Id"
+	ReplyToHeader         = "Reply-To"
+	ExpirationHeader      = "Expiration"
+	MessageIdHeader       = "Message-Id"
+	TimestampHeader       = "Timestamp"
+	TypeHeader            = "Type"
+	UserIdHeader          = "User-Id"
+	AppIdHeader           = "App-Id"
+)
+
+// headerValue converts an AMQP table value to a string. Numbers and
+// booleans are formatted, byte arrays base64 encoded, timestamps
+// formatted as RFC 3339 and nested tables and arrays JSON encoded.
+// The type of the value is not kept, publishing the header again
+// sends it as a string.
+func headerValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case []byte:
+		return base64.StdEncoding.EncodeToString(t)
+	case amqp.Decimal:
+		return decimalString(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339)
+	case amqp.Table, []interface{}:
+		b, err := json.Marshal(jsonValue(t))
+		if err != nil {
+			return fmt.Sprint(t)
+		}
+		return string(b)
+	default:
+		// numbers and booleans
+		return fmt.Sprint(t)
+	}
+}
+
+// jsonValue prepares nested tables and arrays for JSON encoding.
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case amqp.Table:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, v := range t {
+			a[i] = jsonValue(v)
+		}
+		return a
+	case amqp.Decimal:
+		return json.Number(decimalString(t))
+	default:
+		return t
+	}
+}
+
+func decimalString(d amqp.Decimal) string {
+	if d.Scale == 0 {
+		return strconv.FormatInt(int64(d.Value), 10)
+	}
+	return strconv.FormatFloat(float64(d.Value)/pow10(d.Scale), 'f', int(d.Scale), 64)
+}
+
+func pow10(n uint8) float64 {
+	p := 1.0
+	for i := uint8(0); i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// toMessage converts a delivery to a broker message, the
+// properties being set as their well-known headers.
+func toMessage(d amqp.Delivery) *broker.Message {
+	header := make(map[string]string, len(d.Headers))
+	for k, v := range d.Headers {
+		header[k] = headerValue(v)
+	}
+
+	setHeader := func(k, v string) {
+		if len(v) > 0 {
+			header[k] = v
+		}
+	}
+
+	setHeader(ContentTypeHeader, d.ContentType)
+	setHeader(ContentEncodingHeader, d.ContentEncoding)
+	setHeader(CorrelationIdHeader, d.CorrelationId)
+	setHeader(ReplyToHeader, d.ReplyTo)
+	setHeader(ExpirationHeader, d.Expiration)
+	setHeader(MessageIdHeader, d.MessageId)
+	setHeader(TypeHeader, d.Type)
+	setHeader(UserIdHeader, d.UserId)
+	setHeader(AppIdHeader, d.AppId)
+
+	if d.DeliveryMode > 0 {
+		header[DeliveryModeHeader] = strconv.Itoa(int(d.DeliveryMode))
+	}
+	if d.Priority > 0 {
+		header[PriorityHeader] = strconv.Itoa(int(d.Priority))
+	}
+	if !d.Timestamp.IsZero() {
+		header[TimestampHeader] = d.Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	return &broker.Message{
+		Header: header,
+		Body:   d.Body,
+	}
+}
+
+// toPublishing converts a broker message to a publishing. The well-known
+// headers are set as properties, all others as table headers. Values the
+// server would reject, closing the channel, are kept as table headers:
+// an expiration which isn't a number of milliseconds and a user id which
+// isn't the user of the connection.
+func toPublishing(msg *broker.Message, user string) amqp.Publishing {
+	m := amqp.Publishing{
+		Body:    msg.Body,
+		Headers: amqp.Table{},
+	}
+
+	for k, v := range msg.Header {
+		switch k {
+		case ContentTypeHeader:
+			m.ContentType = v
+		case ContentEncodingHeader:
+			m.ContentEncoding = v
+		case CorrelationIdHeader:
+			m.CorrelationId = v
+		case ReplyToHeader:
+			m.ReplyTo = v
+		case ExpirationHeader:
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+				m.Headers[k] = v
+				continue
+			}
+			m.Expiration = v
+		case MessageIdHeader:
+			m.MessageId = v
+		case TypeHeader:
+			m.Type = v
+		case UserIdHeader:
+			if v != user {
+				m.Headers[k] = v
+				continue
+			}
+			m.UserId = v
+		case AppIdHeader:
+			m.AppId = v
+		case DeliveryModeHeader:
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				m.Headers[k] = v
+				continue
+			}
+			m.DeliveryMode = uint8(n)
+		case PriorityHeader:
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				m.Headers[k] = v
+				continue
+			}
+			m.Priority = uint8(n)
+		case TimestampHeader:
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				m.Headers[k] = v
+				continue
+			}
+			m.Timestamp = t
+		default:
+			m.Headers[k] = v
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,106 @@
+package rabbitmq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/streadway/amqp"
+)
+
+func TestHeaderValue(t *testing.T) {
+	testcases := []struct {
+		title string
+		value interface{}
+		want  string
+	}{
+		{"string", "foo", "foo"},
+		{"bool", true, "true"},
+		{"int32", int32(42), "42"},
+		{"int64", int64(-7), "-7"},
+		{"float64", 1.5, "1.5"},
+		{"decimal", amqp.Decimal{Scale: 2, Value: 1234}, "12.34"},
+		{"bytes", []byte("foo"), "Zm9v"},
+		{"timestamp", time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC), "2017-01-02T03:04:05Z"},
+		{"table", amqp.Table{"a": int32(1), "b": "c"}, `{"a":1,"b":"c"}`},
+		{"array", []interface{}{"a", int64(1), true}, `["a",1,true]`},
+		{"nil", nil, ""},
+	}
+
+	for _, test := range testcases {
+		if have := headerValue(test.value); have != test.want {
+			t.Errorf("%s: want %q, have %q", test.title, test.want, have)
+		}
+	}
+}
+
+func TestMessageProperties(t *testing.T) {
+	msg := &broker.Message{
+		Header: map[string]string{
+			ContentTypeHeader:   "application/json",
+			MessageIdHeader:     "123",
+			CorrelationIdHeader: "456",
+			TimestampHeader:     "2017-01-02T03:04:05Z",
+			PriorityHeader:      "5",
+			"foo":               "bar",
+		},
+		Body: []byte("hello"),
+	}
+
+	p := toPublishing(msg, "guest")
+
+	if p.ContentType != "application/json" || p.MessageId != "123" || p.CorrelationId != "456" || p.Priority != 5 {
+		t.Fatalf("properties not set: %+v", p)
+	}
+
+	if !p.Timestamp.Equal(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("timestamp not set: %v", p.Timestamp)
+	}
+
+	if want := (amqp.Table{"foo": "bar"}); !reflect.DeepEqual(p.Headers, want) {
+		t.Fatalf("want headers %v, have %v", want, p.Headers)
+	}
+
+	m := toMessage(amqp.Delivery{
+		Headers:       p.Headers,
+		ContentType:   p.ContentType,
+		MessageId:     p.MessageId,
+		CorrelationId: p.CorrelationId,
+		Priority:      p.Priority,
+		Timestamp:     p.Timestamp,
+		Body:          p.Body,
+	})
+
+	if !reflect.DeepEqual(m.Header, msg.Header) {
+		t.Fatalf("want header %v, have %v", msg.Header, m.Header)
+	}
+}
+
+func TestRejectedProperties(t *testing.T) {
+	testcases := []struct {
+		title  string
+		header map[string]string
+		check  func(amqp.Publishing) bool
+	}{
+		{"expiration", map[string]string{ExpirationHeader: "60000"}, func(p amqp.Publishing) bool {
+			return p.Expiration == "60000" && len(p.Headers) == 0
+		}},
+		{"invalid expiration", map[string]string{ExpirationHeader: "1m"}, func(p amqp.Publishing) bool {
+			return len(p.Expiration) == 0 && p.Headers[ExpirationHeader] == "1m"
+		}},
+		{"user id", map[string]string{UserIdHeader: "guest"}, func(p amqp.Publishing) bool {
+			return p.UserId == "guest" && len(p.Headers) == 0
+		}},
+		{"other user id", map[string]string{UserIdHeader: "bob"}, func(p amqp.Publishing) bool {
+			return len(p.UserId) == 0 && p.Headers[UserIdHeader] == "bob"
+		}},
+	}
+
+	for _, test := range testcases {
+		p := toPublishing(&broker.Message{Header: test.header}, "guest")
+		if !test.check(p) {
+			t.Errorf("%s: unexpected publishing %+v", test.title, p)
+		}
+	}
+}
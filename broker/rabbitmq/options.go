@@ -0,0 +1,126 @@
+package rabbitmq
+
+import (
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"golang.org/x/net/context"
+)
+
+type exchangeKey struct{}
+
+type exchangeKindKey struct{}
+
+type durableExchangeKey struct{}
+
+type durableQueueKey struct{}
+
+type queueArgumentsKey struct{}
+
+type headersKey struct{}
+
+type prefetchCountKey struct{}
+
+type requeueOnErrorKey struct{}
+
+type deadLetterKey struct{}
+
+type confirmTimeoutKey struct{}
+
+type mandatoryKey struct{}
+
+func setBrokerOption(k, v interface{}) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+func setSubscribeOption(k, v interface{}) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+// Exchange sets the name of the exchange messages are published to
+func Exchange(name string) broker.Option {
+	return setBrokerOption(exchangeKey{}, name)
+}
+
+// ExchangeKind sets the kind of the exchange, one of
+// topic (default), direct, fanout or headers
+func ExchangeKind(kind string) broker.Option {
+	return setBrokerOption(exchangeKindKey{}, kind)
+}
+
+// DurableExchange declares the exchange durable so it survives a broker restart
+func DurableExchange() broker.Option {
+	return setBrokerOption(durableExchangeKey{}, true)
+}
+
+// DurableQueue declares the queue durable instead of auto-delete,
+// so it survives a broker restart and keeps messages while
+// no subscriber is connected
+func DurableQueue() broker.SubscribeOption {
+	return setSubscribeOption(durableQueueKey{}, true)
+}
+
+// QueueArguments sets the arguments the queue is declared with,
+// e.g. x-message-ttl or x-max-length
+func QueueArguments(args map[string]interface{}) broker.SubscribeOption {
+	return setSubscribeOption(queueArgumentsKey{}, args)
+}
+
+// Headers sets the arguments the queue is bound with,
+// used to match messages on a headers exchange
+func Headers(h map[string]interface{}) broker.SubscribeOption {
+	return setSubscribeOption(headersKey{}, h)
+}
+
+// PrefetchCount limits the number of unacknowledged messages delivered to
+// the subscriber. It only applies when AutoAck is disabled as auto acked
+// messages are never outstanding.
+func PrefetchCount(n int) broker.SubscribeOption {
+	return setSubscribeOption(prefetchCountKey{}, n)
+}
+
+// RequeueOnError requeues messages the handler returned an error for. By
+// default they are rejected without requeue, which drops them or sends
+// them to the dead letter exchange. It only applies when AutoAck is disabled.
+func RequeueOnError() broker.SubscribeOption {
+	return setSubscribeOption(requeueOnErrorKey{}, true)
+}
+
+// DeadLetterExchange sends rejected and expired messages of the queue to
+// exchange, with the routing key key if set. The exchange is declared
+// along with a durable queue of the same name which collects the messages.
+func DeadLetterExchange(exchange, key string) broker.SubscribeOption {
+	return setSubscribeOption(deadLetterKey{}, &deadLetter{
+		exchange: exchange,
+		key:      key,
+	})
+}
+
+// PublisherConfirms makes Publish wait up to timeout until the broker
+// confirms the message. A message nacked by the broker, or not confirmed
+// in time, is returned as an error.
+func PublisherConfirms(timeout time.Duration) broker.Option {
+	return setBrokerOption(confirmTimeoutKey{}, timeout)
+}
+
+// Mandatory publishes the message as mandatory, so Publish returns
+// ErrUnroutable if no queue is bound for it. It requires PublisherConfirms,
+// otherwise Publish returns ErrMandatory.
+func Mandatory() broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, mandatoryKey{}, true)
+	}
+}
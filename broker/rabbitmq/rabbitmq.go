@@ -1,6 +1,9 @@
 package rabbitmq
 
 import (
+	"errors"
+	"time"
+
 	"github.com/micro/go-micro/broker"
 	"github.com/micro/go-micro/cmd"
 	"github.com/streadway/amqp"
@@ -22,6 +25,9 @@ type publication struct {
 	d amqp.Delivery
 	m *broker.Message
 	t string
+
+	// acked or nacked by the handler
+	done bool
 }
 
 func init() {
@@ -29,9 +35,17 @@ func init() {
 }
 
 func (p *publication) Ack() error {
+	p.done = true
 	return p.d.Ack(false)
 }
 
+// Nack rejects the message. It is requeued if requeue is set, otherwise it
+// is dropped or sent to the dead letter exchange of the queue.
+func (p *publication) Nack(requeue bool) error {
+	p.done = true
+	return p.d.Nack(false, requeue)
+}
+
 func (p *publication) Topic() string {
 	return p.t
 }
@@ -53,19 +67,30 @@ func (s *subscriber) Unsubscribe() error {
 }
 
 func (r *rbroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
-	m := amqp.Publishing{
-		Body:    msg.Body,
-		Headers: amqp.Table{},
+	if r.conn == nil {
+		return errors.New("not connected")
+	}
+
+	m := toPublishing(msg, r.conn.user())
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
 	}
 
-	for k, v := range msg.Header {
-		m.Headers[k] = v
+	var mandatory bool
+	if options.Context != nil {
+		mandatory, _ = options.Context.Value(mandatoryKey{}).(bool)
 	}
 
-	return r.conn.Publish(r.conn.exchange, topic, m)
+	return r.conn.Publish(r.conn.exchange.name, topic, mandatory, m)
 }
 
 func (r *rbroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if r.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
 	opt := broker.SubscribeOptions{
 		AutoAck: true,
 	}
@@ -74,21 +99,17 @@ func (r *rbroker) Subscribe(topic string, handler broker.Handler, opts ...broker
 		o(&opt)
 	}
 
-	ch, sub, err := r.conn.Consume(opt.Queue, topic, opt.AutoAck)
+	ch, sub, err := r.conn.Consume(opt.Queue, topic, opt.AutoAck, consumeOpts(opt))
 	if err != nil {
 		return nil, err
 	}
 
 	fn := func(msg amqp.Delivery) {
-		header := make(map[string]string)
-		for k, v := range msg.Headers {
-			header[k], _ = v.(string)
+		p := &publication{d: msg, m: toMessage(msg), t: topic}
+		// auto acked messages can't be rejected
+		if err := handler(p); err != nil && !opt.AutoAck && !p.done {
+			p.Nack(requeueOnError(opt))
 		}
-		m := &broker.Message{
-			Header: header,
-			Body:   msg.Body,
-		}
-		handler(&publication{d: msg, m: m, t: topic})
 	}
 
 	go func() {
@@ -123,12 +144,61 @@ func (r *rbroker) Init(opts ...broker.Option) error {
 }
 
 func (r *rbroker) Connect() error {
+	if r.conn == nil {
+		r.conn = newRabbitMQConn(r.getExchange(), r.opts.Addrs)
+		if r.opts.Context != nil {
+			r.conn.confirmTimeout, _ = r.opts.Context.Value(confirmTimeoutKey{}).(time.Duration)
+		}
+	}
 	<-r.conn.Init(r.opts.Secure, r.opts.TLSConfig)
 	return nil
 }
 
+func (r *rbroker) getExchange() exchange {
+	var ex exchange
+	if r.opts.Context == nil {
+		return ex
+	}
+	ex.name, _ = r.opts.Context.Value(exchangeKey{}).(string)
+	ex.kind, _ = r.opts.Context.Value(exchangeKindKey{}).(string)
+	ex.durable, _ = r.opts.Context.Value(durableExchangeKey{}).(bool)
+	return ex
+}
+
+func requeueOnError(opt broker.SubscribeOptions) bool {
+	if opt.Context == nil {
+		return false
+	}
+	requeue, _ := opt.Context.Value(requeueOnErrorKey{}).(bool)
+	return requeue
+}
+
+func consumeOpts(opt broker.SubscribeOptions) consumeOptions {
+	var co consumeOptions
+	if opt.Context == nil {
+		return co
+	}
+	co.durable, _ = opt.Context.Value(durableQueueKey{}).(bool)
+	co.prefetch, _ = opt.Context.Value(prefetchCountKey{}).(int)
+	if args, ok := opt.Context.Value(queueArgumentsKey{}).(map[string]interface{}); ok {
+		co.args = amqp.Table(args)
+	}
+	if h, ok := opt.Context.Value(headersKey{}).(map[string]interface{}); ok {
+		co.headers = amqp.Table(h)
+	}
+	if dl, ok := opt.Context.Value(deadLetterKey{}).(*deadLetter); ok {
+		co.deadLetter = dl
+	}
+	return co
+}
+
 func (r *rbroker) Disconnect() error {
+	if r.conn == nil {
+		return nil
+	}
 	r.conn.Close()
+	// a closed connection can't be reused, Connect creates a new one
+	r.conn = nil
 	return nil
 }
 
@@ -139,7 +209,6 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 	}
 
 	return &rbroker{
-		conn:  newRabbitMQConn("", options.Addrs),
 		addrs: options.Addrs,
 		opts:  options,
 	}
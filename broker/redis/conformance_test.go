@@ -0,0 +1,37 @@
+package redis
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-plugins/broker/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		return NewBroker(broker.Addrs(url))
+	},
+		conformance.Skip(conformance.CompetingConsumers, "Pub/Sub delivers to every subscriber, use Streams"),
+		conformance.Skip(conformance.AckRedelivery, "Pub/Sub has no acks, use Streams"),
+		conformance.Settle(500*time.Millisecond),
+	)
+}
+
+func TestStreamsConformance(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not defined")
+	}
+
+	conformance.Run(t, func() broker.Broker {
+		// claim unacked entries before the suite times out
+		return NewBroker(broker.Addrs(url), Streams(), StreamClaimIdle(time.Second))
+	})
+}
@@ -13,6 +13,9 @@ var (
 	DefaultConnectTimeout = 5 * time.Second
 	DefaultReadTimeout    = 5 * time.Second
 	DefaultWriteTimeout   = 5 * time.Second
+	DefaultReconnectMin   = 100 * time.Millisecond
+	DefaultReconnectMax   = 30 * time.Second
+	DefaultPingInterval   = 30 * time.Second
 
 	optionsKey = optionsKeyType{}
 )
@@ -25,6 +28,20 @@ type brokerOptions struct {
 	connectTimeout time.Duration
 	readTimeout    time.Duration
 	writeTimeout   time.Duration
+	reconnectMin   time.Duration
+	reconnectMax   time.Duration
+	pingInterval   time.Duration
+
+	// topology
+	sentinelMaster string
+	cluster        bool
+
+	// streams mode
+	streams      bool
+	streamBlock  time.Duration
+	streamCount  int
+	claimIdle    time.Duration
+	streamMaxLen int
 }
 
 type optionsKeyType struct{}
@@ -70,3 +87,75 @@ func IdleTimeout(d time.Duration) broker.Option {
 		bo.idleTimeout = d
 	}
 }
+
+// ReconnectBackoff sets the delay before a subscriber reconnects after the
+// connection was lost. It starts at min and doubles with every failed
+// attempt up to max.
+func ReconnectBackoff(min, max time.Duration) broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.reconnectMin = min
+		bo.reconnectMax = max
+	}
+}
+
+// PingInterval sets how often a subscriber pings Redis while waiting for
+// messages. Subscriber connections have no read timeout, a subscriber
+// which gets no reply within the interval plus the read timeout considers
+// the connection lost and reconnects. Zero disables the pings.
+func PingInterval(d time.Duration) broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.pingInterval = d
+	}
+}
+
+// Sentinel discovers the master named master through Redis Sentinel. The
+// broker addresses are the addresses of the sentinels.
+func Sentinel(master string) broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.sentinelMaster = master
+	}
+}
+
+// Cluster connects to a Redis Cluster. The broker addresses are used as
+// startup nodes to discover the cluster. Each node gets a pool with the
+// pool settings of the broker.
+func Cluster() broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.cluster = true
+	}
+}
+
+// Streams uses Redis Streams instead of pub/sub. Messages are appended with
+// XADD and read with XREADGROUP using the subscribe queue as consumer group,
+// so they are kept for subscribers which are offline and Ack is supported.
+// Requires Redis 5.0 or later.
+func Streams() broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.streams = true
+	}
+}
+
+// StreamClaimIdle sets how long an entry stays pending with a consumer
+// before another consumer of the group claims it.
+func StreamClaimIdle(d time.Duration) broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.claimIdle = d
+	}
+}
+
+// StreamMaxLen sets the length streams are trimmed to when a message is
+// published, with XADD MAXLEN ~. The oldest entries are dropped whether
+// they were read or not, so it should leave room for the backlog of
+// offline subscribers. Zero, the default, keeps all entries.
+func StreamMaxLen(n int) broker.Option {
+	return func(o *broker.Options) {
+		bo := o.Context.Value(optionsKey).(*brokerOptions)
+		bo.streamMaxLen = n
+	}
+}
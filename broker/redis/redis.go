@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -41,54 +42,182 @@ func (p *publication) Ack() error {
 
 // subscriber proxies and handles Redis messages as broker publications.
 type subscriber struct {
-	conn   *redis.PubSubConn
+	pool   pool
 	topic  string
 	handle broker.Handler
 	opts   broker.SubscribeOptions
+	bopts  *brokerOptions
+
+	// pattern subscriptions use PSUBSCRIBE
+	pattern bool
+
+	sync.Mutex
+	conn *redis.PubSubConn
+
+	once sync.Once
+	exit chan bool
 }
 
-// recv loops to receive new messages from Redis and handle them
-// as publications.
-func (s *subscriber) recv() {
-	// Close the connection once the subscriber stops receiving.
-	defer s.conn.Close()
+// isPattern returns whether the topic contains glob-style wildcards.
+func isPattern(topic string) bool {
+	return strings.ContainsAny(topic, "*?[")
+}
+
+// connect gets a new connection from the pool and subscribes to the topic.
+func (s *subscriber) connect() error {
+	conn := &redis.PubSubConn{Conn: s.pool.Get()}
+
+	var err error
+	if s.pattern {
+		err = conn.PSubscribe(s.topic)
+	} else {
+		err = conn.Subscribe(s.topic)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.Lock()
+	s.conn = conn
+	s.Unlock()
+
+	return nil
+}
 
+// recv receives messages until the subscriber unsubscribes. When the
+// connection is lost it reconnects with backoff and subscribes again.
+func (s *subscriber) recv() {
 	for {
-		switch x := s.conn.Receive().(type) {
-		case redis.Message:
-			var m broker.Message
+		s.Lock()
+		conn := s.conn
+		s.Unlock()
+
+		// Unsubscribed while reconnecting.
+		select {
+		case <-s.exit:
+			conn.Close()
+			return
+		default:
+		}
 
-			// Handle error? Only a log would be necessary since this type
-			// of issue cannot be fixed.
-			if err := json.Unmarshal(x.Data, &m); err != nil {
-				break
+		err := s.receive(conn)
+
+		// Close the connection once the subscriber stops receiving,
+		// Unsubscribe mustn't use it while reconnecting.
+		conn.Close()
+		s.Lock()
+		s.conn = nil
+		s.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		for i := uint(0); ; i++ {
+			d := s.bopts.reconnectMin << i
+			if d <= 0 || d > s.bopts.reconnectMax {
+				d = s.bopts.reconnectMax
 			}
 
-			p := publication{
-				topic:   x.Channel,
-				message: &m,
+			select {
+			case <-s.exit:
+				return
+			case <-time.After(d):
 			}
 
-			// Handle error? Retry?
-			if err := s.handle(&p); err != nil {
+			if err := s.connect(); err == nil {
 				break
 			}
+		}
+	}
+}
 
-			// Added for posterity, however Ack is a no-op.
-			if s.opts.AutoAck {
-				if err := p.Ack(); err != nil {
-					break
-				}
-			}
+// receive loops to receive new messages from Redis and handle them
+// as publications. It returns nil once unsubscribed.
+func (s *subscriber) receive(conn *redis.PubSubConn) error {
+	// The read timeout of the pool applies to replies, a subscription
+	// may be idle for longer. Wait for as long as a ping takes instead.
+	var timeout time.Duration
+	if s.bopts.pingInterval > 0 {
+		timeout = s.bopts.pingInterval + s.bopts.readTimeout
+
+		done := make(chan bool)
+		defer close(done)
+		go s.ping(conn, done)
+	}
+
+	for {
+		switch x := conn.ReceiveWithTimeout(timeout).(type) {
+		case redis.Message:
+			s.process(x.Channel, x.Data)
+
+		case redis.PMessage:
+			s.process(x.Channel, x.Data)
 
 		case redis.Subscription:
 			if x.Count == 0 {
-				return
+				return nil
 			}
 
 		case error:
+			select {
+			case <-s.exit:
+				return nil
+			default:
+				return x
+			}
+		}
+	}
+}
+
+// ping pings Redis on the connection every ping interval until done is
+// closed, so that receive notices a dead connection.
+func (s *subscriber) ping(conn *redis.PubSubConn, done chan bool) {
+	t := time.NewTicker(s.bopts.pingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
 			return
+		case <-t.C:
 		}
+
+		// Unsubscribe writes to the connection as well.
+		s.Lock()
+		err := conn.Ping("")
+		s.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// process decodes and handles a single message.
+func (s *subscriber) process(channel string, data []byte) {
+	var m broker.Message
+
+	// Handle error? Only a log would be necessary since this type
+	// of issue cannot be fixed.
+	if err := json.Unmarshal(data, &m); err != nil {
+		return
+	}
+
+	p := publication{
+		topic:   channel,
+		message: &m,
+	}
+
+	// Handle error? Retry?
+	if err := s.handle(&p); err != nil {
+		return
+	}
+
+	// Added for posterity, however Ack is a no-op.
+	if s.opts.AutoAck {
+		p.Ack()
 	}
 }
 
@@ -104,15 +233,34 @@ func (s *subscriber) Topic() string {
 
 // Unsubscribe unsubscribes the subscriber and frees the connection.
 func (s *subscriber) Unsubscribe() error {
+	s.once.Do(func() {
+		close(s.exit)
+	})
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Reconnecting, the receiver stops on exit.
+	if s.conn == nil {
+		return nil
+	}
+
+	if s.pattern {
+		return s.conn.PUnsubscribe()
+	}
 	return s.conn.Unsubscribe()
 }
 
 // broker implementation for Redis.
 type nbroker struct {
 	addr  string
-	pool  *redis.Pool
+	pool  pool
 	opts  broker.Options
 	bopts *brokerOptions
+
+	// credentials of sentinel and cluster node addresses
+	password string
+	db       int
 }
 
 // String returns the name of the broker implementation.
@@ -151,37 +299,54 @@ func (b *nbroker) Connect() error {
 		return nil
 	}
 
+	var addrs []string
+	for _, addr := range b.opts.Addrs {
+		if len(addr) > 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	// Sentinel and cluster addresses are node addresses.
+	switch {
+	case len(b.bopts.sentinelMaster) > 0:
+		if len(addrs) == 0 {
+			addrs = []string{"127.0.0.1:26379"}
+		}
+		addrs = b.nodes(addrs)
+		b.addr = strings.Join(addrs, ",")
+		b.pool = b.sentinelPool(addrs)
+		return nil
+	case b.bopts.cluster:
+		if len(addrs) == 0 {
+			addrs = []string{"127.0.0.1:6379"}
+		}
+		addrs = b.nodes(addrs)
+		p, err := b.clusterPool(addrs)
+		if err != nil {
+			return err
+		}
+		b.addr = strings.Join(addrs, ",")
+		b.pool = p
+		return nil
+	}
+
 	var addr string
 
-	if len(b.opts.Addrs) == 0 || b.opts.Addrs[0] == "" {
+	if len(addrs) == 0 {
 		addr = "redis://127.0.0.1:6379"
 	} else {
-		addr = b.opts.Addrs[0]
+		addr = addrs[0]
 
-		if !strings.HasPrefix("redis://", addr) {
+		if !strings.HasPrefix(addr, "redis://") {
 			addr = "redis://" + addr
 		}
 	}
 
 	b.addr = addr
 
-	b.pool = &redis.Pool{
-		MaxIdle:     b.bopts.maxIdle,
-		MaxActive:   b.bopts.maxActive,
-		IdleTimeout: b.bopts.idleTimeout,
-		Dial: func() (redis.Conn, error) {
-			return redis.DialURL(
-				b.addr,
-				redis.DialConnectTimeout(b.bopts.connectTimeout),
-				redis.DialReadTimeout(b.bopts.readTimeout),
-				redis.DialWriteTimeout(b.bopts.writeTimeout),
-			)
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-	}
+	b.pool = b.newPool(func() (redis.Conn, error) {
+		return redis.DialURL(b.addr, b.dialOptions()...)
+	})
 
 	return nil
 }
@@ -201,6 +366,10 @@ func (b *nbroker) Publish(topic string, msg *broker.Message, opts ...broker.Publ
 		return err
 	}
 
+	if b.bopts.streams {
+		return b.publishStream(topic, v)
+	}
+
 	conn := b.pool.Get()
 	_, err = redis.Int(conn.Do("PUBLISH", topic, v))
 	conn.Close()
@@ -210,26 +379,35 @@ func (b *nbroker) Publish(topic string, msg *broker.Message, opts ...broker.Publ
 
 // Subscribe returns a subscriber for the topic and handler.
 func (b *nbroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
-	var options broker.SubscribeOptions
+	options := broker.SubscribeOptions{
+		AutoAck: true,
+	}
 	for _, o := range opts {
 		o(&options)
 	}
 
-	s := subscriber{
-		conn:   &redis.PubSubConn{b.pool.Get()},
-		topic:  topic,
-		handle: handler,
-		opts:   options,
+	if b.bopts.streams {
+		return b.subscribeStream(topic, handler, options)
 	}
 
-	// Run the receiver routine.
-	go s.recv()
+	s := &subscriber{
+		pool:    b.pool,
+		topic:   topic,
+		handle:  handler,
+		opts:    options,
+		bopts:   b.bopts,
+		pattern: isPattern(topic),
+		exit:    make(chan bool),
+	}
 
-	if err := s.conn.Subscribe(s.topic); err != nil {
+	if err := s.connect(); err != nil {
 		return nil, err
 	}
 
-	return &s, nil
+	// Run the receiver routine.
+	go s.recv()
+
+	return s, nil
 }
 
 // NewBroker returns a new broker implemented using the Redis pub/sub
@@ -244,6 +422,13 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 		connectTimeout: DefaultConnectTimeout,
 		readTimeout:    DefaultReadTimeout,
 		writeTimeout:   DefaultWriteTimeout,
+		streamBlock:    DefaultStreamBlock,
+		streamCount:    DefaultStreamCount,
+		claimIdle:      DefaultStreamClaimIdle,
+		streamMaxLen:   DefaultStreamMaxLen,
+		reconnectMin:   DefaultReconnectMin,
+		reconnectMax:   DefaultReconnectMax,
+		pingInterval:   DefaultPingInterval,
 	}
 
 	// Initialize with empty broker options.
@@ -0,0 +1,342 @@
+package redis
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/micro/go-micro/broker"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// DefaultStreamBlock is how long XREADGROUP blocks waiting for
+	// new entries. It has to be shorter than the read timeout.
+	DefaultStreamBlock = time.Second
+	// DefaultStreamClaimIdle is how long an entry stays pending with a
+	// consumer before another consumer of the group claims it.
+	DefaultStreamClaimIdle = 30 * time.Second
+	// DefaultStreamCount is the maximum number of entries read at once.
+	DefaultStreamCount = 10
+	// DefaultStreamMaxLen is the length streams are trimmed to on XADD,
+	// approximately. Zero keeps all entries.
+	DefaultStreamMaxLen = 0
+
+	// streamField is the entry field holding the encoded broker.Message.
+	streamField = "message"
+)
+
+// streamEntry is a single entry of a Redis stream.
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// streamPublication is a publication read from a Redis stream.
+type streamPublication struct {
+	pool    pool
+	topic   string
+	group   string
+	id      string
+	message *broker.Message
+}
+
+// Topic returns the topic this publication applies to.
+func (p *streamPublication) Topic() string {
+	return p.topic
+}
+
+// Message returns the broker message of the publication.
+func (p *streamPublication) Message() *broker.Message {
+	return p.message
+}
+
+// Ack removes the entry from the pending list of the consumer group.
+func (p *streamPublication) Ack() error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XACK", p.topic, p.group, p.id)
+	return err
+}
+
+// streamSubscriber reads a Redis stream as a member of a consumer group.
+type streamSubscriber struct {
+	pool     pool
+	topic    string
+	group    string
+	consumer string
+	handle   broker.Handler
+	opts     broker.SubscribeOptions
+	bopts    *brokerOptions
+
+	// destroy the group on unsubscribe, set
+	// when the group is private to the subscriber
+	destroy bool
+
+	once sync.Once
+	exit chan bool
+	done chan bool
+}
+
+// Options returns the subscriber options.
+func (s *streamSubscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+// Topic returns the topic of the subscriber.
+func (s *streamSubscriber) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe stops reading the stream. Entries which were not acknowledged
+// stay pending and are claimed by the other consumers of the group. The
+// consumer is removed from the group unless it has entries pending, which
+// would be dropped with it.
+func (s *streamSubscriber) Unsubscribe() error {
+	s.once.Do(func() {
+		close(s.exit)
+	})
+	<-s.done
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if s.destroy {
+		_, err := conn.Do("XGROUP", "DESTROY", s.topic, s.group)
+		return err
+	}
+
+	pending, err := redis.Values(conn.Do("XPENDING", s.topic, s.group, "-", "+", 1, s.consumer))
+	if err != nil || len(pending) > 0 {
+		return err
+	}
+
+	_, err = conn.Do("XGROUP", "DELCONSUMER", s.topic, s.group, s.consumer)
+	return err
+}
+
+// recv loops to read new entries and to claim the entries which stayed
+// pending for longer than the claim idle time.
+func (s *streamSubscriber) recv() {
+	defer close(s.done)
+
+	lastClaim := time.Now()
+
+	for {
+		select {
+		case <-s.exit:
+			return
+		default:
+		}
+
+		entries, err := s.read()
+		if err != nil {
+			log.Println("redis: stream read error:", err)
+			// avoid spinning while redis is unavailable
+			select {
+			case <-s.exit:
+				return
+			case <-time.After(s.bopts.streamBlock):
+			}
+			continue
+		}
+
+		if time.Since(lastClaim) > s.bopts.claimIdle {
+			claimed, err := s.claim()
+			if err != nil {
+				log.Println("redis: stream claim error:", err)
+			}
+			entries = append(entries, claimed...)
+			lastClaim = time.Now()
+		}
+
+		for _, e := range entries {
+			s.process(e)
+		}
+	}
+}
+
+// read returns the new entries for this consumer.
+func (s *streamSubscriber) read() ([]streamEntry, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do(
+		"XREADGROUP", "GROUP", s.group, s.consumer,
+		"COUNT", s.bopts.streamCount,
+		"BLOCK", int64(s.bopts.streamBlock/time.Millisecond),
+		"STREAMS", s.topic, ">",
+	))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// one reply per stream: [name, entries]
+	var entries []streamEntry
+	for _, r := range reply {
+		stream, err := redis.Values(r, nil)
+		if err != nil || len(stream) != 2 {
+			continue
+		}
+		e, err := parseEntries(stream[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+	return entries, nil
+}
+
+// claim takes over the entries pending for longer than the claim idle
+// time, with dead consumers of the group or with this one because the
+// handler failed or didn't ack them. XREADGROUP only returns new entries,
+// so this is how they are delivered again.
+func (s *streamSubscriber) claim() ([]streamEntry, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	pending, err := redis.Values(conn.Do("XPENDING", s.topic, s.group, "-", "+", s.bopts.streamCount))
+	if err != nil {
+		return nil, err
+	}
+
+	idle := int64(s.bopts.claimIdle / time.Millisecond)
+	args := redis.Args{s.topic, s.group, s.consumer, idle}
+
+	// [id, consumer, idle, deliveries]
+	var ids int
+	for _, p := range pending {
+		v, err := redis.Values(p, nil)
+		if err != nil || len(v) < 3 {
+			continue
+		}
+		elapsed, _ := redis.Int64(v[2], nil)
+		if elapsed < idle {
+			continue
+		}
+		id, _ := redis.String(v[0], nil)
+		args = append(args, id)
+		ids++
+	}
+
+	if ids == 0 {
+		return nil, nil
+	}
+
+	return parseEntries(conn.Do("XCLAIM", args...))
+}
+
+// process decodes and handles a single entry.
+func (s *streamSubscriber) process(e streamEntry) {
+	p := &streamPublication{
+		pool:  s.pool,
+		topic: s.topic,
+		group: s.group,
+		id:    e.id,
+	}
+
+	var m broker.Message
+
+	// The entry was deleted or cannot be decoded, it will never be
+	// handled so remove it from the pending list.
+	data, ok := e.fields[streamField]
+	if !ok || json.Unmarshal([]byte(data), &m) != nil {
+		p.Ack()
+		return
+	}
+
+	p.message = &m
+
+	// The entry stays pending on error and is claimed, by
+	// this or another consumer, once the claim idle time passed.
+	if err := s.handle(p); err != nil {
+		return
+	}
+
+	if s.opts.AutoAck {
+		if err := p.Ack(); err != nil {
+			log.Println("redis: stream ack error:", err)
+		}
+	}
+}
+
+// parseEntries parses a list of stream entries of the form [id, [field, value, ...]].
+func parseEntries(reply interface{}, err error) ([]streamEntry, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(values))
+	for _, v := range values {
+		e, err := redis.Values(v, nil)
+		if err != nil || len(e) != 2 {
+			continue
+		}
+		id, err := redis.String(e[0], nil)
+		if err != nil {
+			continue
+		}
+		// fields are nil for deleted entries
+		fields, _ := redis.StringMap(e[1], nil)
+		entries = append(entries, streamEntry{id: id, fields: fields})
+	}
+	return entries, nil
+}
+
+// publishStream appends the message to the stream of the topic, trimming
+// the oldest entries once the stream is longer than the max length. The
+// trimming is approximate, Redis only drops whole nodes of the stream.
+func (b *nbroker) publishStream(topic string, v []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{topic}
+	if b.bopts.streamMaxLen > 0 {
+		args = args.Add("MAXLEN", "~", b.bopts.streamMaxLen)
+	}
+	args = args.Add("*", streamField, v)
+
+	_, err := conn.Do("XADD", args...)
+	return err
+}
+
+// subscribeStream joins the consumer group of the queue, or a group of its
+// own if no queue is set, and starts reading the stream.
+func (b *nbroker) subscribeStream(topic string, handler broker.Handler, options broker.SubscribeOptions) (broker.Subscriber, error) {
+	s := &streamSubscriber{
+		pool:     b.pool,
+		topic:    topic,
+		group:    options.Queue,
+		consumer: uuid.NewUUID().String(),
+		handle:   handler,
+		opts:     options,
+		bopts:    b.bopts,
+		exit:     make(chan bool),
+		done:     make(chan bool),
+	}
+
+	if len(s.group) == 0 {
+		s.group = s.consumer
+		s.destroy = true
+	}
+
+	conn := b.pool.Get()
+	_, err := conn.Do("XGROUP", "CREATE", topic, s.group, "$", "MKSTREAM")
+	conn.Close()
+
+	// the group exists if another member of the queue created it
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	go s.recv()
+
+	return s, nil
+}
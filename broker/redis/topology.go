@@ -0,0 +1,214 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// pool provides the connections of the broker, it is implemented
+// by *redis.Pool and by clusterPool for Redis Cluster.
+type pool interface {
+	Get() redis.Conn
+	Close() error
+}
+
+// hostPort strips the scheme, credentials and database from a redis://
+// address and returns them separately.
+func hostPort(addr string) (host, password string, db int) {
+	if !strings.HasPrefix(addr, "redis://") {
+		return addr, "", 0
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr, "", 0
+	}
+	if u.User != nil {
+		password, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); len(p) > 0 {
+		db, _ = strconv.Atoi(p)
+	}
+	return u.Host, password, db
+}
+
+// nodes returns the host:port of the node addresses. The password and
+// database of the first address which has them are used for all nodes.
+func (b *nbroker) nodes(addrs []string) []string {
+	b.password, b.db = "", 0
+
+	nodes := make([]string, len(addrs))
+	for i, addr := range addrs {
+		host, password, db := hostPort(addr)
+		if len(b.password) == 0 {
+			b.password = password
+		}
+		if b.db == 0 {
+			b.db = db
+		}
+		nodes[i] = host
+	}
+	return nodes
+}
+
+// timeoutOptions returns the timeout dial options from the broker options.
+func (b *nbroker) timeoutOptions() []redis.DialOption {
+	return []redis.DialOption{
+		redis.DialConnectTimeout(b.bopts.connectTimeout),
+		redis.DialReadTimeout(b.bopts.readTimeout),
+		redis.DialWriteTimeout(b.bopts.writeTimeout),
+	}
+}
+
+// dialOptions returns the dial options of data nodes, the
+// timeouts plus the password and database of the addresses.
+func (b *nbroker) dialOptions() []redis.DialOption {
+	opts := b.timeoutOptions()
+	if len(b.password) > 0 {
+		opts = append(opts, redis.DialPassword(b.password))
+	}
+	if b.db > 0 {
+		opts = append(opts, redis.DialDatabase(b.db))
+	}
+	return opts
+}
+
+// newPool returns a connection pool using the pool settings of the broker.
+func (b *nbroker) newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     b.bopts.maxIdle,
+		MaxActive:   b.bopts.maxActive,
+		IdleTimeout: b.bopts.idleTimeout,
+		Dial:        dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// sentinelPool returns a pool which dials the master
+// discovered through the sentinels.
+func (b *nbroker) sentinelPool(sentinels []string) *redis.Pool {
+	p := b.newPool(func() (redis.Conn, error) {
+		addr, err := b.sentinelMaster(sentinels)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Dial("tcp", addr, b.dialOptions()...)
+	})
+
+	// Drop connections to a master which was demoted by a failover.
+	p.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		role, err := redis.Values(c.Do("ROLE"))
+		if err != nil {
+			return err
+		}
+		if r, _ := redis.String(role[0], nil); r != "master" {
+			return errors.New("redis: not a master")
+		}
+		return nil
+	}
+
+	return p
+}
+
+// sentinelMaster asks the sentinels in turn for the address of the master.
+func (b *nbroker) sentinelMaster(sentinels []string) (string, error) {
+	err := errors.New("redis: no sentinel available")
+
+	for _, addr := range sentinels {
+		var conn redis.Conn
+		// sentinels don't share the password of the master
+		conn, err = redis.Dial("tcp", addr, b.timeoutOptions()...)
+		if err != nil {
+			continue
+		}
+
+		var master []string
+		master, err = redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", b.bopts.sentinelMaster))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		if len(master) != 2 {
+			err = errors.New("redis: unknown sentinel master " + b.bopts.sentinelMaster)
+			continue
+		}
+
+		return net.JoinHostPort(master[0], master[1]), nil
+	}
+
+	return "", err
+}
+
+// clusterPool provides connections to a Redis Cluster.
+type clusterPool struct {
+	*redisc.Cluster
+}
+
+// clusterConn sends commands through a connection which follows cluster
+// redirects and keeps the underlying connection for pub/sub.
+type clusterConn struct {
+	redis.Conn
+	retry redis.Conn
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.retry.Do(cmd, args...)
+}
+
+// ReceiveWithTimeout receives on the underlying connection, without
+// a timeout if it doesn't support one.
+func (c *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if cwt, ok := c.Conn.(redis.ConnWithTimeout); ok {
+		return cwt.ReceiveWithTimeout(timeout)
+	}
+	return c.Conn.Receive()
+}
+
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoWithTimeout(c.retry, timeout, cmd, args...)
+}
+
+func (c *clusterConn) Close() error {
+	return c.retry.Close()
+}
+
+// Get returns a connection which is bound to the node
+// of the key of the first command.
+func (c *clusterPool) Get() redis.Conn {
+	conn := c.Cluster.Get()
+	retry, err := redisc.RetryConn(conn, 3, 100*time.Millisecond)
+	if err != nil {
+		return conn
+	}
+	return &clusterConn{Conn: conn, retry: retry}
+}
+
+// clusterPool returns a pool for the cluster of the startup nodes.
+func (b *nbroker) clusterPool(nodes []string) (*clusterPool, error) {
+	c := &redisc.Cluster{
+		StartupNodes: nodes,
+		DialOptions:  b.dialOptions(),
+		CreatePool: func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+			return b.newPool(func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, opts...)
+			}), nil
+		},
+	}
+
+	// Load the slot mapping of the cluster.
+	if err := c.Refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &clusterPool{c}, nil
+}
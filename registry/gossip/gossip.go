@@ -6,9 +6,12 @@ package gossip
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,6 +20,8 @@ import (
 	"github.com/micro/go-micro/registry"
 	"github.com/mitchellh/hashstructure"
 	"github.com/pborman/uuid"
+
+	"golang.org/x/net/context"
 )
 
 type action int
@@ -38,11 +43,23 @@ type delegate struct {
 }
 
 type gossipRegistry struct {
+	opts       registry.Options
+	addrs      []string
 	broadcasts *memberlist.TransmitLimitedQueue
 	updates    chan *update
 
+	// memberlist is created once, on Init or the
+	// first call, and the error kept for later calls
+	once sync.Once
+	err  error
+
 	sync.RWMutex
 	services map[string][]*registry.Service
+	member   *memberlist.Memberlist
+	// services registered by this node by node id
+	local map[string]*registry.Service
+	left  bool
+	exit  chan bool
 
 	s    sync.RWMutex
 	subs map[string]chan *registry.Result
@@ -60,6 +77,17 @@ var (
 	// You should change this if using secure
 	DefaultKey = []byte("gossipKey")
 	ExpiryTick = time.Second * 10
+	// JoinRetry is the interval to retry joining the
+	// members while this node has no other member
+	JoinRetry = time.Second * 10
+	// LeaveTimeout is how long Leave waits for the deregistrations
+	// to be broadcast and for the leave to propagate
+	LeaveTimeout = time.Second * 5
+
+	// ErrNotSupported is returned for registries which are not a gossip registry
+	ErrNotSupported = errors.New("gossip: not a gossip registry")
+	// ErrLeft is returned by the calls of a registry which left the cluster
+	ErrLeft = errors.New("gossip: registry left the cluster")
 )
 
 func init() {
@@ -137,6 +165,100 @@ func delServices(old, del []*registry.Service) []*registry.Service {
 	return services
 }
 
+func (e *events) NotifyJoin(n *memberlist.Node) {
+	if e.join != nil {
+		e.join(n)
+	}
+}
+
+func (e *events) NotifyLeave(n *memberlist.Node) {
+	if e.leave != nil {
+		e.leave(n)
+	}
+}
+
+func (e *events) NotifyUpdate(n *memberlist.Node) {
+	if e.update != nil {
+		e.update(n)
+	}
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, p, nil
+}
+
+// configure returns the memberlist config set by the options
+func configure(options registry.Options) (*memberlist.Config, error) {
+	var c *memberlist.Config
+
+	profile, _ := options.Context.Value(contextProfileKey{}).(Profile)
+	switch profile {
+	case LANProfile:
+		c = memberlist.DefaultLANConfig()
+	case WANProfile:
+		c = memberlist.DefaultWANConfig()
+	default:
+		c = memberlist.DefaultLocalConfig()
+	}
+
+	// random port unless set
+	c.BindPort = 0
+
+	if addr, ok := options.Context.Value(contextBindAddressKey{}).(string); ok {
+		host, port, err := splitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind address %s: %v", addr, err)
+		}
+		if len(host) > 0 {
+			c.BindAddr = host
+		}
+		c.BindPort = port
+	}
+
+	if addr, ok := options.Context.Value(contextAdvertiseAddressKey{}).(string); ok {
+		host, port, err := splitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid advertise address %s: %v", addr, err)
+		}
+		c.AdvertiseAddr = host
+		c.AdvertisePort = port
+	}
+
+	if d, ok := options.Context.Value(contextGossipIntervalKey{}).(time.Duration); ok {
+		c.GossipInterval = d
+	}
+
+	if d, ok := options.Context.Value(contextProbeIntervalKey{}).(time.Duration); ok {
+		c.ProbeInterval = d
+	}
+
+	if d, ok := options.Context.Value(contextPushPullIntervalKey{}).(time.Duration); ok {
+		c.PushPullInterval = d
+	}
+
+	if e, ok := options.Context.Value(contextEventsKey{}).(*events); ok {
+		c.Events = e
+	}
+
+	if options.Secure {
+		k, ok := options.Context.Value(contextSecretKey{}).([]byte)
+		if !ok {
+			k = DefaultKey
+		}
+		c.SecretKey = k
+	}
+
+	return c, nil
+}
+
 func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
 	return false
 }
@@ -268,7 +390,13 @@ func (m *gossipRegistry) run() {
 		t := time.NewTicker(ExpiryTick)
 		defer t.Stop()
 
-		for _ = range t.C {
+		for {
+			select {
+			case <-m.exit:
+				return
+			case <-t.C:
+			}
+
 			now := time.Now().Unix()
 
 			mtx.Lock()
@@ -280,14 +408,26 @@ func (m *gossipRegistry) run() {
 					// set to delete
 					v.Action = delAction
 					// fire a new update
-					m.updates <- v
+					select {
+					case m.updates <- v:
+					case <-m.exit:
+						mtx.Unlock()
+						return
+					}
 				}
 			}
 			mtx.Unlock()
 		}
 	}()
 
-	for u := range m.updates {
+	for {
+		var u *update
+		select {
+		case <-m.exit:
+			return
+		case u = <-m.updates:
+		}
+
 		switch u.Action {
 		case addAction:
 			m.Lock()
@@ -344,13 +484,188 @@ func (m *gossipRegistry) run() {
 	}
 }
 
+// connect creates the memberlist and joins the members once.
+// The error is returned by every call after, ErrLeft once left.
+func (m *gossipRegistry) connect() error {
+	m.RLock()
+	left, created := m.left, m.member != nil
+	m.RUnlock()
+	if left {
+		return ErrLeft
+	}
+	if created {
+		return nil
+	}
+
+	// held while creating so Leave can't miss the memberlist
+	m.Lock()
+	if m.left {
+		m.Unlock()
+		return ErrLeft
+	}
+	var ml *memberlist.Memberlist
+	m.once.Do(func() {
+		ml, m.err = m.create()
+		m.member = ml
+	})
+	err := m.err
+	m.Unlock()
+
+	// joining syncs the state through the run loop, which needs the lock
+	if ml != nil && len(m.addrs) > 0 {
+		if _, err := ml.Join(m.addrs); err != nil {
+			log.Printf("Error joining members, retrying in %v: %v", JoinRetry, err)
+		}
+		go m.join(ml)
+	}
+
+	return err
+}
+
+// create creates the memberlist, called with the lock held
+func (m *gossipRegistry) create() (*memberlist.Memberlist, error) {
+	c, err := configure(m.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	c.Name = hostname + "-" + uuid.NewUUID().String()
+	c.Delegate = &delegate{
+		updates:    m.updates,
+		broadcasts: m.broadcasts,
+	}
+
+	ml, err := memberlist.Create(c)
+	if err != nil {
+		return nil, fmt.Errorf("error creating memberlist: %v", err)
+	}
+
+	log.Printf("Local memberlist node %s:%d\n", ml.LocalNode().Addr, ml.LocalNode().Port)
+
+	return ml, nil
+}
+
+// join retries joining the members in the background while
+// none could be reached or this node got isolated from them
+func (m *gossipRegistry) join(ml *memberlist.Memberlist) {
+	t := time.NewTicker(JoinRetry)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.exit:
+			return
+		case <-t.C:
+		}
+
+		m.RLock()
+		left := m.left
+		m.RUnlock()
+
+		if left || ml.NumMembers() > 1 {
+			continue
+		}
+
+		if _, err := ml.Join(m.addrs); err != nil {
+			log.Printf("Error joining members, retrying in %v: %v", JoinRetry, err)
+		}
+	}
+}
+
+// broadcast queues the updates for the other members. The notify
+// channel, if not nil, is closed once they were transmitted.
+func (m *gossipRegistry) broadcast(updates []*update, notify chan<- struct{}) {
+	b, _ := json.Marshal(updates)
+
+	m.broadcasts.QueueBroadcast(&broadcast{
+		msg:    append([]byte("d"), b...),
+		notify: notify,
+	})
+}
+
+// Init creates the memberlist and joins the members. It's called by
+// the first call of the registry otherwise, which returns its error.
+func (m *gossipRegistry) Init() error {
+	return m.connect()
+}
+
+// Leave broadcasts the deregistration of the services registered
+// by this node and leaves the cluster, waiting up to LeaveTimeout.
+// The registry can't be used after, its calls return ErrLeft.
+func (m *gossipRegistry) Leave() error {
+	m.Lock()
+	if m.left {
+		m.Unlock()
+		return nil
+	}
+	ml := m.member
+	local := m.local
+	m.local = make(map[string]*registry.Service)
+	m.left = true
+	m.Unlock()
+
+	// the run loop handles updates until the memberlist is shut down
+	defer close(m.exit)
+
+	// never joined
+	if ml == nil {
+		return nil
+	}
+
+	timeout := time.After(LeaveTimeout)
+
+	// nobody to tell if we are alone
+	if ml.NumMembers() > 1 {
+		var notify []chan struct{}
+		for _, s := range local {
+			ch := make(chan struct{})
+			m.broadcast([]*update{
+				&update{
+					Action:  delAction,
+					Service: s,
+				},
+			}, ch)
+			notify = append(notify, ch)
+		}
+
+	wait:
+		for _, ch := range notify {
+			select {
+			case <-ch:
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+
+	err := ml.Leave(LeaveTimeout)
+	if serr := ml.Shutdown(); err == nil {
+		err = serr
+	}
+	return err
+}
+
 func (m *gossipRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if err := m.connect(); err != nil {
+		return err
+	}
+
 	m.Lock()
 	if service, ok := m.services[s.Name]; !ok {
 		m.services[s.Name] = []*registry.Service{s}
 	} else {
 		m.services[s.Name] = addServices(service, []*registry.Service{s})
 	}
+	for _, n := range s.Nodes {
+		m.local[n.Id] = &registry.Service{
+			Name:      s.Name,
+			Version:   s.Version,
+			Metadata:  s.Metadata,
+			Endpoints: s.Endpoints,
+			Nodes:     []*registry.Node{n},
+		}
+	}
 	m.Unlock()
 
 	var options registry.RegisterOptions
@@ -358,24 +673,23 @@ func (m *gossipRegistry) Register(s *registry.Service, opts ...registry.Register
 		o(&options)
 	}
 
-	b, _ := json.Marshal([]*update{
+	m.broadcast([]*update{
 		&update{
 			Action:    addAction,
 			Service:   s,
 			Timestamp: time.Now().Unix(),
 			Expires:   int64(options.TTL.Seconds()),
 		},
-	})
-
-	m.broadcasts.QueueBroadcast(&broadcast{
-		msg:    append([]byte("d"), b...),
-		notify: nil,
-	})
+	}, nil)
 
 	return nil
 }
 
 func (m *gossipRegistry) Deregister(s *registry.Service) error {
+	if err := m.connect(); err != nil {
+		return err
+	}
+
 	m.Lock()
 	if service, ok := m.services[s.Name]; ok {
 		if services := delServices(service, []*registry.Service{s}); len(services) == 0 {
@@ -384,24 +698,26 @@ func (m *gossipRegistry) Deregister(s *registry.Service) error {
 			m.services[s.Name] = services
 		}
 	}
+	for _, n := range s.Nodes {
+		delete(m.local, n.Id)
+	}
 	m.Unlock()
 
-	b, _ := json.Marshal([]*update{
+	m.broadcast([]*update{
 		&update{
 			Action:  delAction,
 			Service: s,
 		},
-	})
-
-	m.broadcasts.QueueBroadcast(&broadcast{
-		msg:    append([]byte("d"), b...),
-		notify: nil,
-	})
+	}, nil)
 
 	return nil
 }
 
 func (m *gossipRegistry) GetService(name string) ([]*registry.Service, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+
 	m.RLock()
 	service, ok := m.services[name]
 	m.RUnlock()
@@ -412,6 +728,10 @@ func (m *gossipRegistry) GetService(name string) ([]*registry.Service, error) {
 }
 
 func (m *gossipRegistry) ListServices() ([]*registry.Service, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+
 	var services []*registry.Service
 	m.RLock()
 	for _, service := range m.services {
@@ -422,6 +742,10 @@ func (m *gossipRegistry) ListServices() ([]*registry.Service, error) {
 }
 
 func (m *gossipRegistry) Watch() (registry.Watcher, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+
 	n, e := m.subscribe()
 	return newGossipWatcher(n, e)
 }
@@ -430,14 +754,39 @@ func (m *gossipRegistry) String() string {
 	return "gossip"
 }
 
+// Init creates the memberlist of a gossip registry and joins the
+// members, returning the error the first registry call would.
+func Init(r registry.Registry) error {
+	m, ok := r.(*gossipRegistry)
+	if !ok {
+		return ErrNotSupported
+	}
+	return m.Init()
+}
+
+// Leave broadcasts the deregistration of the services registered
+// with a gossip registry and leaves the cluster. Call it on shutdown.
+func Leave(r registry.Registry) error {
+	m, ok := r.(*gossipRegistry)
+	if !ok {
+		return ErrNotSupported
+	}
+	return m.Leave()
+}
+
+// NewRegistry returns a gossip registry. The memberlist is created
+// on Init or the first call, which return the error if it fails.
+// The members at the registry addresses are joined in the background
+// until one can be reached.
 func NewRegistry(opts ...registry.Option) registry.Registry {
-	var options registry.Options
+	options := registry.Options{
+		Context: context.Background(),
+	}
 	for _, o := range opts {
 		o(&options)
 	}
 
 	cAddrs := []string{}
-	hostname, _ := os.Hostname()
 	updates := make(chan *update, 100)
 
 	for _, addr := range options.Addrs {
@@ -454,42 +803,17 @@ func NewRegistry(opts ...registry.Option) registry.Registry {
 	}
 
 	mr := &gossipRegistry{
+		opts:       options,
+		addrs:      cAddrs,
 		broadcasts: broadcasts,
 		services:   make(map[string][]*registry.Service),
+		local:      make(map[string]*registry.Service),
 		updates:    updates,
 		subs:       make(map[string]chan *registry.Result),
+		exit:       make(chan bool),
 	}
 
 	go mr.run()
 
-	c := memberlist.DefaultLocalConfig()
-	c.BindPort = 0
-	c.Name = hostname + "-" + uuid.NewUUID().String()
-	c.Delegate = &delegate{
-		updates:    updates,
-		broadcasts: broadcasts,
-	}
-
-	if options.Secure {
-		k, ok := options.Context.Value(contextSecretKey{}).([]byte)
-		if !ok {
-			k = DefaultKey
-		}
-		c.SecretKey = k
-	}
-
-	m, err := memberlist.Create(c)
-	if err != nil {
-		log.Fatalf("Error creating memberlist: %v", err)
-	}
-
-	if len(cAddrs) > 0 {
-		_, err := m.Join(cAddrs)
-		if err != nil {
-			log.Fatalf("Error joining members: %v", err)
-		}
-	}
-
-	log.Printf("Local memberlist node %s:%d\n", m.LocalNode().Addr, m.LocalNode().Port)
 	return mr
 }
@@ -1,9 +1,14 @@
 package gossip
 
 import (
+	"net"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/micro/go-micro/registry"
+
+	"golang.org/x/net/context"
 )
 
 func TestDelServices(t *testing.T) {
@@ -76,3 +81,225 @@ func TestDelNodes(t *testing.T) {
 	}
 	t.Logf("Nodes %+v", nodes)
 }
+
+func TestConfigure(t *testing.T) {
+	var joined bool
+
+	options := registry.Options{
+		Context: context.Background(),
+	}
+
+	for _, o := range []registry.Option{
+		BindAddress("0.0.0.0:7946"),
+		AdvertiseAddress("10.0.0.1:17946"),
+		ConfigProfile(WANProfile),
+		GossipInterval(time.Second),
+		NotifyJoin(func(n *memberlist.Node) {
+			joined = true
+		}),
+	} {
+		o(&options)
+	}
+
+	c, err := configure(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.BindAddr != "0.0.0.0" || c.BindPort != 7946 {
+		t.Fatalf("Expected bind address 0.0.0.0:7946 got %s:%d", c.BindAddr, c.BindPort)
+	}
+
+	if c.AdvertiseAddr != "10.0.0.1" || c.AdvertisePort != 17946 {
+		t.Fatalf("Expected advertise address 10.0.0.1:17946 got %s:%d", c.AdvertiseAddr, c.AdvertisePort)
+	}
+
+	if wan := memberlist.DefaultWANConfig(); c.ProbeTimeout != wan.ProbeTimeout {
+		t.Fatalf("Expected WAN probe timeout %v got %v", wan.ProbeTimeout, c.ProbeTimeout)
+	}
+
+	if c.GossipInterval != time.Second {
+		t.Fatalf("Expected gossip interval 1s got %v", c.GossipInterval)
+	}
+
+	if c.Events == nil {
+		t.Fatal("Expected events to be set")
+	}
+
+	c.Events.NotifyJoin(&memberlist.Node{})
+
+	if !joined {
+		t.Fatal("Expected join to be notified")
+	}
+
+	options.Context = context.WithValue(options.Context, contextBindAddressKey{}, "invalid")
+
+	if _, err := configure(options); err == nil {
+		t.Fatal("Expected error for invalid bind address")
+	}
+}
+
+func TestInitError(t *testing.T) {
+	r := NewRegistry(BindAddress("invalid"))
+
+	if err := Init(r); err == nil {
+		t.Fatal("Expected error for invalid bind address")
+	}
+
+	if _, err := r.ListServices(); err == nil {
+		t.Fatal("Expected error to be returned by the first call")
+	}
+
+	// never created
+	if err := Leave(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	r := NewRegistry(BindAddress("127.0.0.1:0"))
+
+	if err := Init(r); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{
+				Id:      "foo-123",
+				Address: "localhost",
+				Port:    9999,
+			},
+		},
+	}
+
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(r.(*gossipRegistry).local); l != 1 {
+		t.Fatalf("Expected 1 local service got %d", l)
+	}
+
+	if err := Leave(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// already left
+	if err := Leave(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Register(service); err != ErrLeft {
+		t.Fatalf("Expected ErrLeft registering after leave got %v", err)
+	}
+
+	if _, err := r.ListServices(); err != ErrLeft {
+		t.Fatalf("Expected ErrLeft listing services after leave got %v", err)
+	}
+}
+
+// freeAddr returns an address on 127.0.0.1 with a port nobody listens on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitService waits until the registry has the service or not
+func waitService(t *testing.T, r registry.Registry, name string, found bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := r.GetService(name)
+		if (err == nil) == found {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for service %s, expected found %v", name, found)
+}
+
+func TestLeaveDeregisters(t *testing.T) {
+	addr := freeAddr(t)
+
+	seed := NewRegistry(BindAddress(addr))
+	if err := Init(seed); err != nil {
+		t.Fatal(err)
+	}
+	defer Leave(seed)
+
+	r := NewRegistry(BindAddress("127.0.0.1:0"), registry.Addrs(addr))
+	if err := Init(r); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{
+				Id:      "foo-123",
+				Address: "localhost",
+				Port:    9999,
+			},
+		},
+	}
+
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	waitService(t, seed, "foo", true)
+
+	if err := Leave(r); err != nil {
+		t.Fatal(err)
+	}
+
+	waitService(t, seed, "foo", false)
+}
+
+func TestJoinLateSeed(t *testing.T) {
+	retry := JoinRetry
+	JoinRetry = 100 * time.Millisecond
+	defer func() {
+		JoinRetry = retry
+	}()
+
+	addr := freeAddr(t)
+
+	// the seed isn't up yet
+	r := NewRegistry(BindAddress("127.0.0.1:0"), registry.Addrs(addr))
+	if err := Init(r); err != nil {
+		t.Fatal(err)
+	}
+	defer Leave(r)
+
+	seed := NewRegistry(BindAddress(addr))
+	if err := Init(seed); err != nil {
+		t.Fatal(err)
+	}
+	defer Leave(seed)
+
+	service := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{
+				Id:      "foo-123",
+				Address: "localhost",
+				Port:    9999,
+			},
+		},
+	}
+
+	if err := seed.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	waitService(t, r, "foo", true)
+}
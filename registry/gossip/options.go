@@ -1,15 +1,129 @@
 package gossip
 
 import (
+	"time"
+
+	"github.com/hashicorp/memberlist"
 	"github.com/micro/go-micro/registry"
 
 	"golang.org/x/net/context"
 )
 
+// Profile is a memberlist configuration profile
+type Profile int
+
+const (
+	// LocalProfile is tuned for a loopback or local network (default)
+	LocalProfile Profile = iota
+	// LANProfile is tuned for a local area network
+	LANProfile
+	// WANProfile is tuned for a wide area network
+	WANProfile
+)
+
 type contextSecretKey struct{}
 
+type contextBindAddressKey struct{}
+
+type contextAdvertiseAddressKey struct{}
+
+type contextProfileKey struct{}
+
+type contextGossipIntervalKey struct{}
+
+type contextProbeIntervalKey struct{}
+
+type contextPushPullIntervalKey struct{}
+
+type contextEventsKey struct{}
+
+// events holds the callbacks for memberlist events
+type events struct {
+	join   func(*memberlist.Node)
+	leave  func(*memberlist.Node)
+	update func(*memberlist.Node)
+}
+
 func SecretKey(k []byte) registry.Option {
 	return func(o *registry.Options) {
 		o.Context = context.WithValue(o.Context, contextSecretKey{}, k)
 	}
 }
+
+func setRegistryOption(k, v interface{}) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+// BindAddress sets the host:port to listen on for gossip.
+// The port is random by default.
+func BindAddress(addr string) registry.Option {
+	return setRegistryOption(contextBindAddressKey{}, addr)
+}
+
+// AdvertiseAddress sets the host:port advertised to other members,
+// e.g. the public address of a host behind NAT or of a container
+func AdvertiseAddress(addr string) registry.Option {
+	return setRegistryOption(contextAdvertiseAddressKey{}, addr)
+}
+
+// ConfigProfile sets the memberlist configuration profile the
+// timeouts and intervals are based on
+func ConfigProfile(p Profile) registry.Option {
+	return setRegistryOption(contextProfileKey{}, p)
+}
+
+// GossipInterval sets the interval between gossip messages
+func GossipInterval(d time.Duration) registry.Option {
+	return setRegistryOption(contextGossipIntervalKey{}, d)
+}
+
+// ProbeInterval sets the interval between failure detection probes
+func ProbeInterval(d time.Duration) registry.Option {
+	return setRegistryOption(contextProbeIntervalKey{}, d)
+}
+
+// PushPullInterval sets the interval between full state syncs
+func PushPullInterval(d time.Duration) registry.Option {
+	return setRegistryOption(contextPushPullIntervalKey{}, d)
+}
+
+func setEvent(fn func(*events)) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		// copy so options already applied aren't changed
+		e := &events{}
+		if prev, ok := o.Context.Value(contextEventsKey{}).(*events); ok {
+			*e = *prev
+		}
+		fn(e)
+		o.Context = context.WithValue(o.Context, contextEventsKey{}, e)
+	}
+}
+
+// NotifyJoin is called when a member joins the cluster
+func NotifyJoin(fn func(*memberlist.Node)) registry.Option {
+	return setEvent(func(e *events) {
+		e.join = fn
+	})
+}
+
+// NotifyLeave is called when a member leaves the cluster or is considered dead
+func NotifyLeave(fn func(*memberlist.Node)) registry.Option {
+	return setEvent(func(e *events) {
+		e.leave = fn
+	})
+}
+
+// NotifyUpdate is called when the metadata of a member is updated
+func NotifyUpdate(fn func(*memberlist.Node)) registry.Option {
+	return setEvent(func(e *events) {
+		e.update = fn
+	})
+}